@@ -1,19 +1,26 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/favoritemedium/fsso/sso"
 )
 
 // Type ErrorResponse represents an error as returned to the caller.
 type ErrorResponse struct {
-	Status  int    `json:"-"`
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
 }
 
 func (e ErrorResponse) Error() string {
@@ -21,53 +28,92 @@ func (e ErrorResponse) Error() string {
 }
 
 var (
-	ErrInvalidJson      = ErrorResponse{400, "format", "Invalid JSON."}
-	ErrBadParameters    = ErrorResponse{400, "parameters", "Invalid Parameters."}
-	ErrMethodNotAllowed = ErrorResponse{405, "method", "Method not allowed."}
-	ErrUnknown          = ErrorResponse{500, "unknown", "Unknown error."}
+	ErrInvalidJson      = ErrorResponse{400, "format", "Invalid JSON.", nil}
+	ErrBadParameters    = ErrorResponse{400, "parameters", "Invalid Parameters.", nil}
+	ErrNotSignedIn      = ErrorResponse{401, "signin", "Not signed in.", nil}
+	ErrMethodNotAllowed = ErrorResponse{405, "method", "Method not allowed.", nil}
+	ErrTooManyRequests  = ErrorResponse{429, "ratelimit", "Too many requests.", nil}
+	ErrUnknown          = ErrorResponse{500, "unknown", "Unknown error.", nil}
 )
 
+// ssoStatus maps error codes from the sso package to http status codes.
+// Codes that aren't listed are 400 Bad Request.
+var ssoStatus = map[string]int{
+	sso.ErrAuthenticationFailure.Code:   401,
+	sso.ErrDisabledAccount.Code:         403,
+	sso.ErrReauthenticationFailure.Code: 403,
+	sso.ErrInvalidMfaCode.Code:          401,
+	sso.ErrReauthRequired.Code:          403,
+	sso.ErrMfaRequired.Code:             403,
+}
+
+// writeError sends an error to the caller.  Errors that didn't come from a
+// handler or from the sso package are logged and reported as unknown.
+func writeError(w http.ResponseWriter, err error) {
+
+	var xerr ErrorResponse
+	switch e := err.(type) {
+	case ErrorResponse:
+		xerr = e
+	case sso.ErrorResponse:
+		// The sso package rejected something the caller sent us.
+		xerr = ErrorResponse{400, e.Code, e.Message, nil}
+		if status, ok := ssoStatus[e.Code]; ok {
+			xerr.Status = status
+		}
+	case *sso.LockoutError:
+		// Tell the caller how long to wait before trying again.
+		w.Header().Set("Retry-After", strconv.FormatInt(e.RetryAfter, 10))
+		xerr = ErrorResponse{429, sso.ErrLockedOut.Code, e.Error(),
+			map[string]int64{"retry_after": e.RetryAfter}}
+	case *sso.PasswordError:
+		// Tell the caller everything that's wrong with the password.
+		xerr = ErrorResponse{400, sso.ErrBadPassword.Code, e.Error(),
+			map[string][]string{"reasons": e.Reasons}}
+	default:
+		// An unexpected error (such as database failure).
+		// Log it so that we can debug.
+		log.Println(err)
+		xerr = ErrUnknown
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(xerr.Status)
+	json.NewEncoder(w).Encode(&xerr)
+}
+
 // wrap adds json encoding/decoding and authentication to an endpoint handler.
-func wrap(handler func(*http.Request, *sso.Member, Parameters) (interface{}, error)) func(http.ResponseWriter, *http.Request) {
+func wrap(handler func(http.ResponseWriter, *http.Request, *sso.Member, Parameters) (interface{}, error)) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		w.Header().Set("Content-Type", "application/json")
-		enc := json.NewEncoder(w)
+		if rateLimited(w, r, "ip:"+sso.ClientIP(r)) {
+			return
+		}
 
 		dataIn, err := ParseParameters(r)
 		if err != nil {
-			w.WriteHeader(ErrInvalidJson.Status)
-			enc.Encode(&ErrInvalidJson)
+			writeError(w, ErrInvalidJson)
 			return
 		}
 
 		m, err := sso.CurrentMember(r)
 		if err != nil {
-			// We have an unexpected error (such as database failure).
-			// Log it so that we can debug.
-			log.Println(err)
-			w.WriteHeader(ErrUnknown.Status)
-			enc.Encode(&ErrUnknown)
+			writeError(w, err)
+			return
+		}
+		if m != nil && rateLimited(w, r, "member:"+strconv.FormatInt(m.GetId(), 10)) {
+			return
 		}
 
-		dataOut, err := handler(r, m, dataIn)
+		dataOut, err := handler(w, r, m, dataIn)
 		if err != nil {
-			if xerr, ok := err.(ErrorResponse); ok {
-				// If our error is an instance of ErrorResponse, that means that the
-				// handler generated it and we should pass it on to the caller
-				w.WriteHeader(xerr.Status)
-				enc.Encode(&xerr)
-			} else {
-				// Another unexpected error.  Log it.
-				log.Println(err)
-				w.WriteHeader(ErrUnknown.Status)
-				enc.Encode(&ErrUnknown)
-			}
+			writeError(w, err)
 			return
 		}
 
-		enc.Encode(&dataOut)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&dataOut)
 	}
 }
 
@@ -75,67 +121,842 @@ func wrap(handler func(*http.Request, *sso.Member, Parameters) (interface{}, err
 // prefix should probably be "/api/auth/".
 func Initialize(prefix string) {
 	sso.InitDB(os.Getenv("MYSQL_TEST_DSN"))
+	configureProviders()
+	configureMail()
+	configurePasswords()
+	configureRateLimits(prefix)
+	configureMfa()
+	configureDeletion()
+	configureSessions()
+	configureJanitor()
 	http.HandleFunc(prefix+"signin", wrap(doSignin))
 	http.HandleFunc(prefix+"connect", wrap(doConnect))
-	http.HandleFunc(prefix+"signout", wrap(notImplemented))
-	http.HandleFunc(prefix+"email/check", wrap(notImplemented))
-	http.HandleFunc(prefix+"email/verify", wrap(notImplemented))
-	http.HandleFunc(prefix+"new", wrap(notImplemented))
-	http.HandleFunc(prefix+"password", wrap(notImplemented))
-	http.HandleFunc(prefix+"list", wrap(notImplemented))
-	http.HandleFunc(prefix+"clear", wrap(notImplemented))
-	http.HandleFunc(prefix+"delete", wrap(notImplemented))
-	http.HandleFunc(prefix+"add", wrap(notImplemented))
-	http.HandleFunc(prefix+"accounts", wrap(notImplemented))
-	http.HandleFunc(prefix+"primary", wrap(notImplemented))
-	http.HandleFunc(prefix+"remove", wrap(notImplemented))
+	http.HandleFunc(prefix+"oauth/", oauthHandler(prefix+"oauth/"))
+	http.HandleFunc(prefix+"nonce", wrap(doNonce))
+	initIdP(prefix + "oidc/")
+	http.HandleFunc(prefix+"signout", wrap(doSignout))
+	http.HandleFunc(prefix+"email/check", wrap(doEmailCheck))
+	http.HandleFunc(prefix+"email/verify", wrap(doEmailVerify))
+	http.HandleFunc(prefix+"email/signin", wrap(doEmailSignin))
+	http.HandleFunc(prefix+"new", wrap(doNew))
+	http.HandleFunc(prefix+"password", wrap(doPassword))
+	http.HandleFunc(prefix+"mfa", wrap(doMfa))
+	http.HandleFunc(prefix+"webauthn/register", wrap(doWebAuthnRegister))
+	http.HandleFunc(prefix+"webauthn/signin", wrap(doWebAuthnSignin))
+	http.HandleFunc(prefix+"webauthn/passkeys", wrap(doPasskeys))
+	http.HandleFunc(prefix+"list", wrap(doList))
+	http.HandleFunc(prefix+"clear", wrap(doClear))
+	http.HandleFunc(prefix+"reauth", wrap(doReauth))
+	http.HandleFunc(prefix+"delete", wrap(doDelete))
+	http.HandleFunc(prefix+"add", wrap(doAdd))
+	http.HandleFunc(prefix+"accounts", wrap(doAccounts))
+	http.HandleFunc(prefix+"primary", wrap(doPrimary))
+	http.HandleFunc(prefix+"remove", wrap(doRemove))
 }
 
 // doSignin handles the /signin endpoint.
-func doSignin(r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+func doSignin(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+
+	var (
+		reply *sso.SigninReply
+		err   error
+	)
+
+	switch {
+	case p.HasExactly("email", "password") && p.AreString("email", "password"):
+		reply, err = sso.SigninEmail(r, p["email"].(string), p["password"].(string))
+	case p.HasExactly("rtoken") && p.AreString("rtoken"):
+		reply, err = sso.SigninRefresh(r, p["rtoken"].(string))
+	case p.HasExactly("ltoken") && p.AreString("ltoken"):
+		reply, err = sso.SigninLink(r, p["ltoken"].(string))
+	case p.HasExactly("mtoken", "code") && p.AreString("mtoken", "code"):
+		reply, err = sso.SigninMFA(r, p["mtoken"].(string), p["code"].(string))
+	case p.HasExactly("credential") && p.AreObject("credential"):
+		var c sso.WebAuthnCredential
+		if !p.Decode("credential", &c) {
+			return nil, ErrBadParameters
+		}
+		reply, err = sso.SigninWebAuthn(r, &c)
+	case p.HasExactly("mtoken", "credential") && p.AreString("mtoken") && p.AreObject("credential"):
+		var c sso.WebAuthnCredential
+		if !p.Decode("credential", &c) {
+			return nil, ErrBadParameters
+		}
+		reply, err = sso.SigninMFAWebAuthn(r, p["mtoken"].(string), &c)
+	case p.HasAll("provider", "id_token") && !p.HasOther("provider", "id_token", "nonce") &&
+		p.AreString("provider", "id_token") && p.AreStringOrAbsent("nonce"):
+		nonce, _ := p["nonce"].(string)
+		reply, err = sso.SigninSocial(r, p["provider"].(string), p["id_token"].(string), nonce)
+	default:
+		return nil, ErrBadParameters
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if c := reply.Cookie(); c != nil {
+		http.SetCookie(w, c)
+	}
+	return reply, nil
+}
+
+// doConnect handles the /connect endpoint.
+func doConnect(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
 
 	if r.Method != "POST" {
 		return nil, ErrMethodNotAllowed
 	}
 
 	if p.HasExactly("email", "password") && p.AreString("email", "password") {
-		return sso.SigninEmail(p["email"].(string), p["password"].(string))
+		return sso.ConnectEmail(r, p["email"].(string), p["password"].(string))
 	}
 
-	if p.HasExactly("rtoken") && p.AreString("rtoken") {
-		return sso.SigninRefresh(p["rtoken"].(string))
+	if p.HasExactly("mtoken", "code") && p.AreString("mtoken", "code") {
+		return sso.ConnectMFA(r, p["mtoken"].(string), p["code"].(string))
 	}
 
-	if p.HasExactly("provider", "id_token") && p.AreString("provider", "id_token") {
-		return sso.SigninSocial(p["provider"].(string), p["id_token"].(string))
+	if p.HasAll("credential") && !p.HasOther("credential", "mtoken") &&
+		p.AreObject("credential") && p.AreStringOrAbsent("mtoken") {
+		var c sso.WebAuthnCredential
+		if !p.Decode("credential", &c) {
+			return nil, ErrBadParameters
+		}
+		if mtoken, ok := p["mtoken"].(string); ok {
+			return sso.ConnectMFAWebAuthn(r, mtoken, &c)
+		}
+		return sso.ConnectWebAuthn(r, &c)
+	}
+
+	if p.HasAll("provider", "id_token") && !p.HasOther("provider", "id_token", "nonce") &&
+		p.AreString("provider", "id_token") && p.AreStringOrAbsent("nonce") {
+		nonce, _ := p["nonce"].(string)
+		return sso.ConnectSocial(r, p["provider"].(string), p["id_token"].(string), nonce)
 	}
 
 	return nil, ErrBadParameters
 }
 
-// doConnect handles the /connect endpoint.
-func doConnect(r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+// doNonce handles the /nonce endpoint, which issues a nonce for the client
+// to request an ID token with.  The token then goes to /signin, /connect,
+// /add or /delete along with the nonce, which can only be used once.
+func doNonce(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if !p.HasExactly() {
+		return nil, ErrBadParameters
+	}
+
+	nonce, expiry, err := sso.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"nonce": nonce, "nonce_expires": expiry}, nil
+}
+
+// doEmailCheck handles the /email/check endpoint, which sends a verify code
+// to an email address that's about to be registered.
+func doEmailCheck(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
 
 	if r.Method != "POST" {
 		return nil, ErrMethodNotAllowed
 	}
 
-	if p.HasExactly("email", "password") && p.AreString("email", "password") {
-		return sso.ConnectEmail(p["email"].(string), p["password"].(string))
+	if !p.HasExactly("email") || !p.AreString("email") {
+		return nil, ErrBadParameters
+	}
+
+	if err := sso.RequestVcode(p["email"].(string), language(r)); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// doEmailVerify handles the /email/verify endpoint, which tells which email
+// address a verify code is for.
+func doEmailVerify(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if !p.HasExactly("vcode") || !p.AreString("vcode") {
+		return nil, ErrBadParameters
+	}
+
+	email, err := sso.GetVerifiedEmail(p["vcode"].(string))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"email": email}, nil
+}
+
+// doEmailSignin handles the /email/signin endpoint, which emails a link for
+// signing in without a password.  The token from the link goes to /signin as
+// ltoken.
+func doEmailSignin(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
 	}
 
-	if p.HasExactly("provider", "id_token") && p.AreString("provider", "id_token") {
-		return sso.ConnectSocial(p["provider"].(string), p["id_token"].(string))
+	if !p.HasExactly("email") || !p.AreString("email") {
+		return nil, ErrBadParameters
+	}
+
+	sso.RequestSigninLink(p["email"].(string), language(r))
+	return struct{}{}, nil
+}
+
+// doNew handles the /new endpoint, which registers a new member.
+func doNew(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+
+	keys := []string{"vcode", "password", "fullname", "shortname"}
+	if !p.HasExactly(keys...) || !p.AreString(keys...) {
+		return nil, ErrBadParameters
+	}
+
+	reply, err := sso.Register(r, p["vcode"].(string), p["password"].(string),
+		p["fullname"].(string), p["shortname"].(string))
+	if err != nil {
+		return nil, err
+	}
+	if c := reply.Cookie(); c != nil {
+		http.SetCookie(w, c)
+	}
+	return reply, nil
+}
+
+// doPassword handles the /password endpoint.  Given an email address, it
+// sends a password reset link.  Given the token from the link and a new
+// password, it resets the password.  Given the current and new passwords of
+// a signed-in member, it changes the password.
+func doPassword(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+
+	if p.HasExactly("email") && p.AreString("email") {
+		sso.RequestPasswordReset(p["email"].(string), language(r))
+		return struct{}{}, nil
+	}
+
+	if p.HasExactly("ptoken", "password") && p.AreString("ptoken", "password") {
+		if err := sso.ResetPassword(p["ptoken"].(string), p["password"].(string), language(r)); err != nil {
+			return nil, err
+		}
+		return struct{}{}, nil
+	}
+
+	if p.HasAll("current", "password") && !p.HasOther("current", "password", "signout_others") &&
+		p.AreString("current", "password") {
+		if m == nil {
+			return nil, ErrNotSignedIn
+		}
+		signoutOthers := false
+		if _, ok := p["signout_others"]; ok {
+			if !p.AreBool("signout_others") {
+				return nil, ErrBadParameters
+			}
+			signoutOthers = p["signout_others"].(bool)
+		}
+		if err := m.ChangePassword(p["current"].(string), p["password"].(string), signoutOthers, language(r)); err != nil {
+			return nil, err
+		}
+		return struct{}{}, nil
+	}
+
+	return nil, ErrBadParameters
+}
+
+// doMfa handles the /mfa endpoint, for setting up two-factor authentication
+// with an authenticator app.  POST with no parameters starts setting it up,
+// and POST with a code from the app confirms it.  DELETE with a code from the
+// app or a recovery code turns it off.  Each needs the member to have signed
+// in or been to /reauth recently.
+func doMfa(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+
+	switch r.Method {
+	case "POST":
+		if p.HasExactly() {
+			return m.EnrollTOTP()
+		}
+		if p.HasExactly("code") && p.AreString("code") {
+			codes, err := m.ConfirmTOTP(p["code"].(string))
+			if err != nil {
+				return nil, err
+			}
+			return map[string][]string{"recovery_codes": codes}, nil
+		}
+	case "DELETE":
+		if p.HasExactly("code") && p.AreString("code") {
+			if err := m.DisableTOTP(p["code"].(string)); err != nil {
+				return nil, err
+			}
+			return struct{}{}, nil
+		}
+	default:
+		return nil, ErrMethodNotAllowed
 	}
 
 	return nil, ErrBadParameters
 }
 
+// doWebAuthnRegister handles the /webauthn/register endpoint, for adding a
+// passkey.  POST with no parameters returns the options for
+// navigator.credentials.create, and POST with the resulting credential (and
+// optionally a name for it) saves it.  The member must have signed in or been
+// to /reauth recently.
+func doWebAuthnRegister(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+
+	if p.HasExactly() {
+		return m.BeginWebAuthnRegistration()
+	}
+
+	if p.HasAll("credential") && !p.HasOther("credential", "name") &&
+		p.AreObject("credential") && p.AreStringOrAbsent("name") {
+		var c sso.WebAuthnCredential
+		if !p.Decode("credential", &c) {
+			return nil, ErrBadParameters
+		}
+		name, _ := p["name"].(string)
+		if err := m.FinishWebAuthnRegistration(&c, name); err != nil {
+			return nil, err
+		}
+		return struct{}{}, nil
+	}
+
+	return nil, ErrBadParameters
+}
+
+// doWebAuthnSignin handles the /webauthn/signin endpoint, which returns the
+// options for navigator.credentials.get.  The resulting credential goes to
+// /signin or /connect.  Given the mtoken from the first step of signing in,
+// the options are for using a passkey as the second factor.
+func doWebAuthnSignin(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if p.HasOther("mtoken") || !p.AreStringOrAbsent("mtoken") {
+		return nil, ErrBadParameters
+	}
+
+	mtoken, _ := p["mtoken"].(string)
+	return sso.BeginWebAuthnSignin(mtoken)
+}
+
+// doPasskeys handles the /webauthn/passkeys endpoint.  GET lists the member's
+// passkeys and DELETE with an id removes one, which needs the member to have
+// signed in or been to /reauth recently.
+func doPasskeys(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+
+	switch r.Method {
+	case "GET":
+		if !p.HasExactly() {
+			return nil, ErrBadParameters
+		}
+		return m.Passkeys()
+	case "DELETE":
+		if !p.HasExactly("id") || !p.AreString("id") {
+			return nil, ErrBadParameters
+		}
+		if err := m.RemovePasskey(p["id"].(string)); err != nil {
+			return nil, err
+		}
+		return struct{}{}, nil
+	}
+	return nil, ErrMethodNotAllowed
+}
+
+// doSignout handles the /signout endpoint, which ends the current session.
+// A refresh token may be given to revoke it as well.
+func doSignout(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+	if !p.HasExactly() && !(p.HasExactly("rtoken") && p.AreString("rtoken")) {
+		return nil, ErrBadParameters
+	}
+
+	rtoken, _ := p["rtoken"].(string)
+	if err := m.Signout(rtoken); err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, sso.SignoutCookie(r))
+	return struct{}{}, nil
+}
+
+// doList handles the /list endpoint, which lists where the member is signed
+// in (GET), or ends one of their other sessions (DELETE, with the session's
+// id) and returns the updated list.
+func doList(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+
+	switch r.Method {
+	case "GET":
+		if !p.HasExactly() {
+			return nil, ErrBadParameters
+		}
+	case "DELETE":
+		if !p.HasExactly("id") || !p.AreString("id") {
+			return nil, ErrBadParameters
+		}
+		if err := m.RevokeSession(p["id"].(string)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrMethodNotAllowed
+	}
+	return m.Sessions()
+}
+
+// doClear handles the /clear endpoint, which signs the member out everywhere
+// except the current session.
+func doClear(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+	if !p.HasExactly() {
+		return nil, ErrBadParameters
+	}
+
+	if err := m.ClearSessions(); err != nil {
+		return nil, err
+	}
+	return m.Sessions()
+}
+
+// doReauth handles the /reauth endpoint, where the member confirms it's them
+// with their password or a fresh id token before changing how they sign in.
+func doReauth(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+
+	var err error
+	switch {
+	case p.HasExactly("password") && p.AreString("password"):
+		err = m.ReauthPassword(p["password"].(string))
+	case p.HasAll("provider", "id_token") && !p.HasOther("provider", "id_token", "nonce") &&
+		p.AreString("provider", "id_token") && p.AreStringOrAbsent("nonce"):
+		nonce, _ := p["nonce"].(string)
+		err = m.ReauthSocial(p["provider"].(string), p["id_token"].(string), nonce)
+	default:
+		return nil, ErrBadParameters
+	}
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// doDelete handles the /delete endpoint, which schedules the member's account
+// for deletion.  The member reauthenticates with their password or a fresh id
+// token, and sets sure to true to confirm.
+func doDelete(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+
+	var (
+		deleteAt int64
+		err      error
+	)
+	switch {
+	case p.HasExactly("password", "sure") && p.AreString("password") && p.AreBool("sure"):
+		deleteAt, err = m.DeleteWithPassword(p["password"].(string), p["sure"].(bool))
+	case p.HasAll("provider", "id_token", "sure") && !p.HasOther("provider", "id_token", "nonce", "sure") &&
+		p.AreString("provider", "id_token") && p.AreStringOrAbsent("nonce") && p.AreBool("sure"):
+		nonce, _ := p["nonce"].(string)
+		deleteAt, err = m.DeleteWithSocial(p["provider"].(string), p["id_token"].(string), nonce, p["sure"].(bool))
+	default:
+		return nil, ErrBadParameters
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The member has been signed out everywhere, including here.
+	http.SetCookie(w, sso.SignoutCookie(r))
+	return map[string]int64{"delete_at": deleteAt}, nil
+}
+
+// doAccounts handles the /accounts endpoint, which lists the ways the member
+// can sign in.
+func doAccounts(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "GET" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+	if !p.HasExactly() {
+		return nil, ErrBadParameters
+	}
+
+	return m.Accounts()
+}
+
+// doAdd handles the /add endpoint, which links another account to the
+// member: either an email address, with a verify code and a password, or a
+// social network account, with an id token.  Returns the updated list of
+// accounts.  Like /primary and /remove, this needs the member to have signed
+// in or been to /reauth recently.
+func doAdd(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+
+	var err error
+	switch {
+	case p.HasExactly("vcode", "password") && p.AreString("vcode", "password"):
+		err = m.AddEmailAccount(p["vcode"].(string), p["password"].(string))
+	case p.HasAll("provider", "id_token") && !p.HasOther("provider", "id_token", "nonce") &&
+		p.AreString("provider", "id_token") && p.AreStringOrAbsent("nonce"):
+		nonce, _ := p["nonce"].(string)
+		err = m.AddSocialAccount(p["provider"].(string), p["id_token"].(string), nonce)
+	default:
+		return nil, ErrBadParameters
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Accounts()
+}
+
+// doPrimary handles the /primary endpoint, which makes one of the member's
+// accounts primary.  Returns the updated list of accounts.
+func doPrimary(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+	if !p.HasExactly("provider") || !p.AreString("provider") {
+		return nil, ErrBadParameters
+	}
+
+	if err := m.SetPrimary(p["provider"].(string)); err != nil {
+		return nil, err
+	}
+	return m.Accounts()
+}
+
+// doRemove handles the /remove endpoint, which unlinks one of the member's
+// accounts other than the primary one.  Returns the updated list of accounts.
+func doRemove(w http.ResponseWriter, r *http.Request, m *sso.Member, p Parameters) (interface{}, error) {
+
+	if r.Method != "POST" {
+		return nil, ErrMethodNotAllowed
+	}
+	if m == nil {
+		return nil, ErrNotSignedIn
+	}
+	if !p.HasExactly("provider") || !p.AreString("provider") {
+		return nil, ErrBadParameters
+	}
+
+	if err := m.RemoveAccount(p["provider"].(string)); err != nil {
+		return nil, err
+	}
+	return m.Accounts()
+}
+
 // notImplemented is a placeholder for an endpoint that is not implemented.
 // For testing purposes it returns the input data and the currently signed-in member.
-func notImplemented(r *http.Request, member *sso.Member, params Parameters) (interface{}, error) {
+func notImplemented(w http.ResponseWriter, r *http.Request, member *sso.Member, params Parameters) (interface{}, error) {
 	resp := make(map[string]interface{})
 	resp[r.Method] = params
 	resp["member"] = member
 	return resp, nil
 }
+
+// configureProviders registers the social sign-in providers that are set up
+// in the environment.
+//
+// GOOGLE_JWKS may name a local file or URL to load Google's keys from instead
+// of the default.  FACEBOOK_GRAPH_URL may point to a stand-in for the Graph
+// API.
+func configureProviders() {
+
+	if id := os.Getenv("GOOGLE_CLIENT_ID"); id != "" {
+		g := sso.NewGoogleProvider(id)
+		g.ClientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
+		if src := os.Getenv("GOOGLE_JWKS"); src != "" {
+			if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+				g.Keys = sso.NewJWKSCache(sso.URLJWKS(nil, src))
+			} else {
+				g.Keys = sso.NewJWKSCache(sso.FileJWKS(src))
+			}
+		}
+		sso.RegisterProvider(g)
+	}
+
+	if id := os.Getenv("FACEBOOK_APP_ID"); id != "" {
+		f := sso.NewFacebookProvider(id, os.Getenv("FACEBOOK_APP_SECRET"))
+		if u := os.Getenv("FACEBOOK_GRAPH_URL"); u != "" {
+			f.GraphURL = u
+		}
+		sso.RegisterProvider(f)
+	}
+
+	// OIDC_PROVIDERS is a space-separated list of names.  Each one needs an
+	// issuer and client id, e.g. OIDC_KEYCLOAK_ISSUER and
+	// OIDC_KEYCLOAK_CLIENT_ID for "keycloak".
+	for _, name := range strings.Fields(os.Getenv("OIDC_PROVIDERS")) {
+		env := "OIDC_" + strings.ToUpper(name) + "_"
+		o := sso.NewOIDCProvider(name, os.Getenv(env+"ISSUER"), os.Getenv(env+"CLIENT_ID"))
+		o.ClientSecret = os.Getenv(env + "CLIENT_SECRET")
+		sso.RegisterProvider(o)
+	}
+}
+
+// configureMail sets up outgoing email from the environment.  Without
+// SMTP_ADDR, email is logged instead, or written to files in MAIL_DIR.
+func configureMail() {
+
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		sso.MailFrom = from
+	}
+	if u := os.Getenv("VERIFY_URL"); u != "" {
+		sso.VerifyURL = u
+	}
+	if u := os.Getenv("RESET_URL"); u != "" {
+		sso.ResetURL = u
+	}
+	if u := os.Getenv("SIGNIN_LINK_URL"); u != "" {
+		sso.SigninLinkURL = u
+	}
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		var auth smtp.Auth
+		if user := os.Getenv("SMTP_USER"); user != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		sso.SetMailer(&sso.SMTPMailer{Addr: addr, Auth: auth})
+	} else {
+		sso.SetMailer(&sso.LogMailer{Dir: os.Getenv("MAIL_DIR")})
+	}
+}
+
+// language returns the caller's preferred language tag from the
+// Accept-Language header, or "" if there isn't one.
+func language(r *http.Request) string {
+	lang := strings.SplitN(r.Header.Get("Accept-Language"), ",", 2)[0]
+	return strings.TrimSpace(strings.SplitN(lang, ";", 2)[0])
+}
+
+// configurePasswords sets up password hashing and the password policy from
+// the environment.  PASSWORD_HASH may be "argon2id" or "scrypt" instead of
+// the default bcrypt.  BREACHED_DIR is a directory of leaked password hashes;
+// see sso.BreachedDir.  LOCKOUT_STORE may be "mysql" to keep counts of failed
+// signins in the database.
+func configurePasswords() {
+
+	switch os.Getenv("PASSWORD_HASH") {
+	case "argon2id":
+		sso.PasswordHasher = sso.NewArgon2idHasher()
+	case "scrypt":
+		sso.PasswordHasher = sso.NewScryptHasher()
+	}
+	if _, ok := sso.PasswordHasher.(*sso.BcryptHasher); !ok {
+		// Only bcrypt has a limit on password length.
+		sso.PasswordRules.MaxBytes = 0
+		sso.PasswordRules.MaxLength = 256
+	}
+
+	if dir := os.Getenv("BREACHED_DIR"); dir != "" {
+		sso.PasswordRules.Breached = sso.BreachedDir(dir)
+	}
+
+	// Failed signins are counted in memory unless LOCKOUT_STORE says to share
+	// them between servers through the database.
+	if os.Getenv("LOCKOUT_STORE") == "mysql" {
+		sso.Lockout.Counter = sso.NewMySQLCounter()
+	}
+}
+
+// configureMfa sets up two-factor authentication from the environment.
+// MFA_REQUIRED_ROLES is a bitmask of roles that members only have once
+// they've passed two-factor authentication.  TOTP_ISSUER is the name shown in
+// authenticator apps.  WEBAUTHN_RP_ID is the domain passkeys are bound to,
+// WEBAUTHN_RP_NAME the name shown for it, and WEBAUTHN_ORIGINS a
+// comma-separated list of the origins of pages allowed to use passkeys.
+func configureMfa() {
+	if s := os.Getenv("MFA_REQUIRED_ROLES"); s != "" {
+		roles, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			log.Fatalf("bad MFA_REQUIRED_ROLES %q", s)
+		}
+		sso.MfaRequiredRoles = uint32(roles)
+	}
+	if s := os.Getenv("TOTP_ISSUER"); s != "" {
+		sso.TOTPIssuer = s
+	}
+	if s := os.Getenv("WEBAUTHN_RP_ID"); s != "" {
+		sso.WebAuthnRPID = s
+	}
+	if s := os.Getenv("WEBAUTHN_RP_NAME"); s != "" {
+		sso.WebAuthnRPName = s
+	}
+	if s := os.Getenv("WEBAUTHN_ORIGINS"); s != "" {
+		sso.WebAuthnOrigins = strings.Split(s, ",")
+	}
+}
+
+// configureDeletion sets the grace period for account deletion from
+// DELETE_GRACE_DAYS.
+func configureDeletion() {
+	if s := os.Getenv("DELETE_GRACE_DAYS"); s != "" {
+		days, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || days < 0 {
+			log.Fatalf("bad DELETE_GRACE_DAYS %q", s)
+		}
+		sso.DeletionGracePeriod = days * 86400
+	}
+}
+
+// configureSessions sets session timeouts from the environment.  Each is a
+// duration such as "720h", with 0 for no limit.  COOKIE_IDLE_TIMEOUT and
+// TOKEN_IDLE_TIMEOUT are how long cookie and token-based sessions may go
+// unused, and COOKIE_LIFETIME and TOKEN_LIFETIME how long they may last in
+// all.  ADMIN_ROLES is a bitmask of roles whose sessions time out after
+// ADMIN_IDLE_TIMEOUT unused; it defaults to 0, for none.
+func configureSessions() {
+	envSeconds("COOKIE_IDLE_TIMEOUT", &sso.CookieTimeouts.Idle)
+	envSeconds("COOKIE_LIFETIME", &sso.CookieTimeouts.Lifetime)
+	envSeconds("TOKEN_IDLE_TIMEOUT", &sso.TokenTimeouts.Idle)
+	envSeconds("TOKEN_LIFETIME", &sso.TokenTimeouts.Lifetime)
+	envSeconds("ADMIN_IDLE_TIMEOUT", &sso.AdminIdleTimeout)
+	if s := os.Getenv("ADMIN_ROLES"); s != "" {
+		roles, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			log.Fatalf("bad ADMIN_ROLES %q", s)
+		}
+		sso.AdminRoles = uint32(roles)
+	}
+}
+
+// envSeconds sets *v to the number of seconds in the duration named by the
+// environment variable, if it's set.
+func envSeconds(name string, v *int64) {
+	if s := os.Getenv(name); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			log.Fatalf("bad %s %q", name, s)
+		}
+		*v = int64(d / time.Second)
+	}
+}
+
+// configureJanitor starts the background cleanup of expired sessions and
+// tokens every JANITOR_INTERVAL, a duration such as "10m".  A JANITOR_INTERVAL
+// of 0 turns the janitor off, for when the embedding application runs
+// sso.RunJanitor itself.
+func configureJanitor() {
+
+	interval := 10 * time.Minute
+
+	if s := os.Getenv("JANITOR_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			log.Fatalf("bad JANITOR_INTERVAL %q", s)
+		}
+		interval = d
+	}
+	if interval > 0 {
+		go sso.RunJanitor(context.Background(), interval)
+	}
+}
+
+// JanitorStats serves the janitor's counts as json.  Initialize doesn't add
+// it to any path, since the counts are only for operators; mount it behind
+// whatever access control the application uses for such things.
+func JanitorStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sso.JanitorStats())
+}
+
+// configureRateLimits sets up request throttling from the environment.
+// RATE_LIMIT is the default limit, as "rate,burst" (see RateLimit).
+// AUTH_RATE_LIMIT is a tighter limit for the endpoints that check passwords
+// or email addresses, which attract credential-stuffing bots.
+func configureRateLimits(prefix string) {
+
+	auth := RateLimit{Rate: 0.2, Burst: 10}
+
+	if l, ok := parseRateLimit(os.Getenv("RATE_LIMIT")); ok {
+		DefaultRateLimit = l
+	}
+	if l, ok := parseRateLimit(os.Getenv("AUTH_RATE_LIMIT")); ok {
+		auth = l
+	}
+	for _, path := range []string{"signin", "connect", "email/check", "email/verify", "email/signin", "new", "password"} {
+		SetRateLimit(prefix+path, auth)
+	}
+}
+
+// parseRateLimit parses a "rate,burst" setting.
+func parseRateLimit(s string) (RateLimit, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return RateLimit{}, false
+	}
+	rate, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	burst, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil {
+		log.Printf("bad rate limit %q", s)
+		return RateLimit{}, false
+	}
+	return RateLimit{rate, burst}, true
+}
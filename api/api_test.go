@@ -0,0 +1,29 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/favoritemedium/fsso/sso"
+)
+
+func TestWriteLockoutError(t *testing.T) {
+
+	w := httptest.NewRecorder()
+	writeError(w, &sso.LockoutError{RetryAfter: 42})
+
+	var body struct {
+		Code    string `json:"code"`
+		Details struct {
+			RetryAfter int64 `json:"retry_after"`
+		} `json:"details"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 429 || w.Header().Get("Retry-After") != "42" ||
+		body.Code != sso.ErrLockedOut.Code || body.Details.RetryAfter != 42 {
+		t.Errorf("got %d %v %+v", w.Code, w.Header(), body)
+	}
+}
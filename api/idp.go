@@ -0,0 +1,176 @@
+package api
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/favoritemedium/fsso/sso"
+)
+
+// initIdP adds the endpoints that let other applications sign their users in
+// through fsso using OpenID Connect, under prefix.  They're only added if a
+// signing key is configured.
+func initIdP(prefix string) {
+
+	keyFile := os.Getenv("OIDC_SIGNING_KEY")
+	if keyFile == "" {
+		return
+	}
+	key, err := loadPrivateKey(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sso.SetSigningKey(key)
+	sso.Issuer = os.Getenv("FSSO_URL") + strings.TrimSuffix(prefix, "/")
+
+	http.HandleFunc(prefix+".well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, sso.Discovery())
+	})
+	http.HandleFunc(prefix+"jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, sso.JWKS())
+	})
+	http.HandleFunc(prefix+"authorize", limited(doAuthorize))
+	http.HandleFunc(prefix+"token", limited(doToken))
+	http.HandleFunc(prefix+"userinfo", limited(doUserInfo))
+}
+
+// loadPrivateKey reads an RSA private key from a PEM file.
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New(path + ": no PEM data")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New(path + ": not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// writeJson sends v to the caller.
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeOAuthError sends an error to a relying party in OAuth2 format.
+func writeOAuthError(w http.ResponseWriter, err error) {
+
+	oerr, ok := err.(sso.OAuthError)
+	if !ok {
+		writeError(w, err)
+		return
+	}
+
+	status := 400
+	switch oerr {
+	case sso.ErrOAuthInvalidClient:
+		status = 401
+	case sso.ErrOAuthInvalidToken:
+		status = 401
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&oerr)
+}
+
+// doAuthorize handles the /oidc/authorize endpoint.  The user is sent here by
+// a relying party, and sent back with an authorization code once signed in.
+func doAuthorize(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, sso.ErrOAuthInvalidRequest)
+		return
+	}
+	if err := sso.CheckAuthorize(r.Form); err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+
+	m, err := sso.CurrentMember(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if m == nil {
+		// Have the user sign in, then come back here with the same request.
+		back := r.URL.Path + "?" + r.Form.Encode()
+		http.Redirect(w, r, os.Getenv("FSSO_LOGIN_URL")+"?"+url.Values{"return_to": {back}}.Encode(), http.StatusFound)
+		return
+	}
+
+	u, err := sso.Authorize(m, r.Form)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// doToken handles the /oidc/token endpoint, where a relying party exchanges
+// an authorization code for tokens.
+func doToken(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		writeError(w, ErrMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, sso.ErrOAuthInvalidRequest)
+		return
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	reply, err := sso.Token(id, secret, r.PostForm)
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, reply)
+}
+
+// doUserInfo handles the /oidc/userinfo endpoint.  The access token must come
+// in the Authorization header; tokens in the URL end up in logs.
+func doUserInfo(w http.ResponseWriter, r *http.Request) {
+
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		writeOAuthError(w, sso.ErrOAuthInvalidToken)
+		return
+	}
+
+	claims, err := sso.UserInfo(token[7:])
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	writeJson(w, claims)
+}
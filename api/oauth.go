@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/favoritemedium/fsso/sso"
+)
+
+// oauthHandler handles the endpoints for signing in with the authorization
+// code flow, where prefix is the path they're under:
+//
+//	<prefix><provider>/start?return_to=/some/path
+//	<prefix><provider>/callback
+//
+// Unlike the other endpoints these are visited by the browser, so on success
+// they redirect rather than return json.
+func oauthHandler(prefix string) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "GET" {
+			writeError(w, ErrMethodNotAllowed)
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		provider := parts[0]
+		redirectURI := os.Getenv("FSSO_URL") + prefix + provider + "/callback"
+		q := r.URL.Query()
+
+		switch parts[1] {
+
+		case "start":
+			u, cookie, err := sso.StartOAuth(provider, redirectURI, q.Get("return_to"))
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			http.SetCookie(w, cookie)
+			http.Redirect(w, r, u, http.StatusFound)
+
+		case "callback":
+			http.SetCookie(w, sso.ClearOAuthStateCookie(redirectURI))
+			if q.Get("error") != "" {
+				// The user declined or the provider refused.
+				writeError(w, sso.ErrAuthenticationFailure)
+				return
+			}
+			reply, returnTo, err := sso.FinishOAuth(r, provider, q.Get("state"), q.Get("code"))
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if c := reply.Cookie(); c != nil {
+				http.SetCookie(w, c)
+			} else {
+				// The member has two-factor authentication, so send them back
+				// with the challenge token for the page to finish signing in.
+				// It goes in the fragment, which browsers don't send anywhere,
+				// so it stays out of logs and Referer headers.
+				returnTo = withFragment(returnTo, url.Values{"mtoken": {reply.Mtoken}})
+			}
+			http.Redirect(w, r, returnTo, http.StatusFound)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// withFragment replaces the fragment of a relative URL with the given
+// parameters.
+func withFragment(u string, v url.Values) string {
+	if i := strings.IndexByte(u, '#'); i >= 0 {
+		u = u[:i]
+	}
+	return u + "#" + v.Encode()
+}
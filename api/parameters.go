@@ -56,6 +56,17 @@ func (p Parameters) AreString(keys ...string) bool {
 	return true
 }
 
+// AreStringOrAbsent returns true if each of the keys specified either refers
+// to a string value or is not present.
+func (p Parameters) AreStringOrAbsent(keys ...string) bool {
+	for _, k := range keys {
+		if _, ok := p[k]; ok && !p.AreString(k) {
+			return false
+		}
+	}
+	return true
+}
+
 // AreInt returns true if all of the keys specified refer to numbers.
 func (p Parameters) AreNumeric(keys ...string) bool {
 	for _, k := range keys {
@@ -78,6 +89,23 @@ func (p Parameters) AreBool(keys ...string) bool {
 	return true
 }
 
+// AreObject returns true if all of the keys specified refer to json objects.
+func (p Parameters) AreObject(keys ...string) bool {
+	for _, k := range keys {
+		if _, ok := p[k].(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode converts the value of a key into v, which should be a pointer to a
+// struct with json tags.  Returns false if the value doesn't fit.
+func (p Parameters) Decode(key string, v interface{}) bool {
+	b, err := json.Marshal(p[key])
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
 // AreNull returns true if all of the keys specified refer to null values.
 func (p Parameters) AreNull(keys ...string) bool {
 	for _, k := range keys {
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/favoritemedium/fsso/sso"
+)
+
+// Type RateLimit is a token bucket: callers may make Burst requests at once,
+// and earn back Rate requests per second after that.  A zero Rate means no
+// limit.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// DefaultRateLimit applies to endpoints that don't have a limit of their own.
+var DefaultRateLimit = RateLimit{Rate: 2, Burst: 60}
+
+// rateLimits holds the limits set for particular endpoints, by path.
+var rateLimits = map[string]RateLimit{}
+
+// SetRateLimit sets the limit for the endpoint at path.  Each client IP has
+// its own bucket for each endpoint, and so does each signed-in member.
+func SetRateLimit(path string, limit RateLimit) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	rateLimits[path] = limit
+}
+
+// Type bucket is the state of one token bucket.  full is when it will have
+// filled up again if left alone.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// maxBuckets is the most buckets that are kept at once.
+var maxBuckets = 100000
+
+// limiter holds the buckets for every endpoint and caller.
+var limiter = struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	ops     int
+}{buckets: make(map[string]*bucket)}
+
+// takeToken takes a token from the bucket for key, which is limited by the
+// endpoint at path.  If the bucket is empty it returns the number of seconds
+// until a token will be available.
+func takeToken(path, key string) (retryAfter int64, ok bool) {
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limit, found := rateLimits[path]
+	if !found {
+		limit = DefaultRateLimit
+	}
+	if limit.Rate <= 0 {
+		return 0, true
+	}
+
+	now := time.Now()
+	sweepBuckets(now)
+
+	key = path + " " + key
+	b := limiter.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: limit.Burst, last: now}
+		limiter.buckets[key] = b
+	}
+
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return int64(math.Ceil((1 - b.tokens) / limit.Rate)), false
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((limit.Burst - b.tokens) / limit.Rate * float64(time.Second)))
+	return 0, true
+}
+
+// sweepBuckets drops buckets that have filled up again, which are no
+// different from new ones.  It runs every so often, and whenever there are
+// maxBuckets buckets; if they're all still in use then, some are dropped at
+// random, so that a flood of callers can't use up all our memory.
+// limiter.mu must be held.
+func sweepBuckets(now time.Time) {
+	limiter.ops++
+	if limiter.ops < 10000 && len(limiter.buckets) < maxBuckets {
+		return
+	}
+	limiter.ops = 0
+	for k, b := range limiter.buckets {
+		if !now.Before(b.full) {
+			delete(limiter.buckets, k)
+		}
+	}
+	for k := range limiter.buckets {
+		if len(limiter.buckets) < maxBuckets-maxBuckets/10 {
+			break
+		}
+		delete(limiter.buckets, k)
+	}
+}
+
+// rateLimited takes a token for the caller identified by key, and sends a 429
+// error if there isn't one.  It returns true if the request should go no
+// further.
+func rateLimited(w http.ResponseWriter, r *http.Request, key string) bool {
+	retryAfter, ok := takeToken(r.URL.Path, key)
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	writeError(w, ErrorResponse{ErrTooManyRequests.Status, ErrTooManyRequests.Code, ErrTooManyRequests.Message,
+		map[string]int64{"retry_after": retryAfter}})
+	return true
+}
+
+// limited rate-limits a handler by client IP, for endpoints that don't go
+// through wrap.
+func limited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited(w, r, "ip:"+sso.ClientIP(r)) {
+			return
+		}
+		handler(w, r)
+	}
+}
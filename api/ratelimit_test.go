@@ -0,0 +1,132 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testRateLimit sets a limit for path, and starts the test with no buckets.
+func testRateLimit(t *testing.T, path string, limit RateLimit) {
+	t.Helper()
+	SetRateLimit(path, limit)
+	limiter.mu.Lock()
+	limiter.buckets = make(map[string]*bucket)
+	limiter.mu.Unlock()
+	t.Cleanup(func() {
+		limiter.mu.Lock()
+		delete(rateLimits, path)
+		limiter.mu.Unlock()
+	})
+}
+
+// age makes the bucket for path and key look as if it was last used d ago.
+func age(path, key string, d time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	b := limiter.buckets[path+" "+key]
+	b.last = b.last.Add(-d)
+	b.full = b.full.Add(-d)
+}
+
+func TestTakeTokenBurst(t *testing.T) {
+
+	testRateLimit(t, "/test", RateLimit{Rate: 0.5, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if _, ok := takeToken("/test", "a"); !ok {
+			t.Fatalf("request %d refused", i+1)
+		}
+	}
+	if retryAfter, ok := takeToken("/test", "a"); ok || retryAfter != 2 {
+		t.Errorf("past the burst: got %d, %v", retryAfter, ok)
+	}
+
+	// Each caller has their own bucket.
+	if _, ok := takeToken("/test", "b"); !ok {
+		t.Error("b refused")
+	}
+}
+
+func TestTakeTokenRefill(t *testing.T) {
+
+	testRateLimit(t, "/test", RateLimit{Rate: 1, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		takeToken("/test", "a")
+	}
+
+	// Two seconds earn two tokens.
+	age("/test", "a", 2*time.Second)
+	for i := 0; i < 2; i++ {
+		if _, ok := takeToken("/test", "a"); !ok {
+			t.Errorf("refilled token %d refused", i+1)
+		}
+	}
+	if _, ok := takeToken("/test", "a"); ok {
+		t.Error("more tokens than refilled")
+	}
+
+	// A long wait only fills the bucket up to the burst.
+	age("/test", "a", time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, ok := takeToken("/test", "a"); !ok {
+			t.Errorf("after an hour: request %d refused", i+1)
+		}
+	}
+	if _, ok := takeToken("/test", "a"); ok {
+		t.Error("after an hour: more than the burst")
+	}
+}
+
+func TestTakeTokenUnlimited(t *testing.T) {
+
+	testRateLimit(t, "/test", RateLimit{Rate: 0, Burst: 0})
+	for i := 0; i < 100; i++ {
+		if _, ok := takeToken("/test", "a"); !ok {
+			t.Fatal("refused with no limit")
+		}
+	}
+}
+
+func TestSweepBuckets(t *testing.T) {
+
+	defer func(n int) { maxBuckets = n }(maxBuckets)
+	maxBuckets = 20
+	testRateLimit(t, "/test", RateLimit{Rate: 1, Burst: 2})
+
+	// Buckets that have filled up again are the first to go.
+	takeToken("/test", "idle")
+	age("/test", "idle", time.Minute)
+	for i := 0; i < 100; i++ {
+		takeToken("/test", string(rune('A'+i)))
+		takeToken("/test", string(rune('A'+i)))
+		limiter.mu.Lock()
+		n := len(limiter.buckets)
+		_, idle := limiter.buckets["/test idle"]
+		limiter.mu.Unlock()
+		if n > maxBuckets {
+			t.Fatalf("%d buckets", n)
+		}
+		if i == 20 && idle {
+			t.Error("full bucket kept")
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+
+	testRateLimit(t, "/test", RateLimit{Rate: 0.1, Burst: 1})
+	r := httptest.NewRequest("GET", "/test", nil)
+
+	if rateLimited(httptest.NewRecorder(), r, "ip:192.0.2.1") {
+		t.Fatal("first request limited")
+	}
+	w := httptest.NewRecorder()
+	if !rateLimited(w, r, "ip:192.0.2.1") {
+		t.Fatal("second request not limited")
+	}
+	if w.Code != 429 || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("got %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,241 @@
+package sso
+
+import "database/sql"
+
+// EmailProvider is the provider name used for email/password accounts.
+const EmailProvider = "email"
+
+// builtinAuthTables lists the auth tables of the built-in providers, whether
+// or not they're registered right now.  A member may still have a primary
+// account in one of them.
+var builtinAuthTables = []string{emailAuthTable, googleAuthTable, facebookAuthTable, oidcAuthTable}
+
+// authTables lists every auth table that has an is_primary column: the
+// built-in ones, and those of any other providers that are registered.
+func authTables() []string {
+	tables := append([]string(nil), builtinAuthTables...)
+	seen := make(map[string]bool)
+	for _, t := range tables {
+		seen[t] = true
+	}
+	for _, p := range Providers() {
+		if t := p.Table(); !seen[t] {
+			seen[t] = true
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// Type Account is one of the ways a member can sign in.  Exactly one of a
+// member's accounts is primary, and the member's email address is the
+// primary account's.
+type Account struct {
+	Provider  string `json:"provider"`
+	Email     string `json:"email"`
+	IsPrimary bool   `json:"is_primary"`
+}
+
+// accountTableFor returns where accounts for the named provider are stored.
+func accountTableFor(provider string) (accountTable, error) {
+	if provider == EmailProvider {
+		return accountTable{name: emailAuthTable}, nil
+	}
+	p := GetProvider(provider)
+	if p == nil {
+		return accountTable{}, ErrUnknownProvider
+	}
+	return tableFor(p), nil
+}
+
+// Accounts lists the member's accounts: email/password first, then social
+// networks in order of provider name.
+func (m *Member) Accounts() ([]*Account, error) {
+
+	names := []string{EmailProvider}
+	for _, p := range Providers() {
+		names = append(names, p.Name())
+	}
+
+	accounts := []*Account{}
+	for _, name := range names {
+		a, err := accountTableFor(name)
+		if err != nil {
+			return nil, err
+		}
+		where, args := a.scope()
+		acct := &Account{Provider: name}
+		err = db.QueryRow(
+			"SELECT email, is_primary FROM "+a.name+" WHERE member_id=?"+where,
+			append([]interface{}{m.id}, args...)...).Scan(&acct.Email, &acct.IsPrimary)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, acct)
+	}
+	return accounts, nil
+}
+
+// AddEmailAccount lets the member sign in with an email address and
+// password as well, using a verify code (see RequestVcode) to prove
+// ownership of the address.  Like the other changes to the member's
+// accounts, this needs recent reauthentication (see requireRecentAuth).
+func (m *Member) AddEmailAccount(vcode, password string) error {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return err
+	}
+
+	email, err := GetVerifiedEmail(vcode)
+	if err != nil {
+		return err
+	}
+	if err := PasswordRules.Check(password, email, m.FullName, m.ShortName); err != nil {
+		return err
+	}
+
+	return inTx(func(t *sql.Tx) error {
+		var n int
+		if err := t.QueryRow(
+			"SELECT COUNT(*) FROM "+emailAuthTable+" WHERE member_id=?",
+			m.id).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrDuplicateAccount
+		}
+		if err := addEmailAuth(t, email, password, m.id, false); err != nil {
+			return err
+		}
+		_, err := t.Exec("DELETE FROM "+emailVerifyTable+" WHERE email=? AND purpose=?", email, purposeRegister)
+		return err
+	})
+}
+
+// AddSocialAccount lets the member sign in with a social network account as
+// well, given an id token for it.  See AuthSocial regarding the nonce.
+// Returns ErrDuplicateAccount if the social account already belongs to a
+// member, or the member already has an account with that provider.
+func (m *Member) AddSocialAccount(provider, idToken, nonce string) error {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return err
+	}
+
+	p, id, err := verifySocial(provider, idToken, nonce)
+	if err != nil {
+		return err
+	}
+
+	// The unique keys on the table catch both kinds of duplicate.
+	return tableFor(p).link(db, m.id, id, false)
+}
+
+// SetPrimary makes one of the member's accounts the primary one, and takes
+// the member's email address from it.  Accounts without a verified email
+// address, such as Facebook ones, can't be primary.
+func (m *Member) SetPrimary(provider string) error {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return err
+	}
+
+	a, err := accountTableFor(provider)
+	if err != nil {
+		return err
+	}
+	where, args := a.scope()
+	args = append([]interface{}{m.id}, args...)
+
+	var email string
+	err = inTx(func(t *sql.Tx) error {
+
+		var isPrimary bool
+		if err := t.QueryRow(
+			"SELECT email, is_primary FROM "+a.name+" WHERE member_id=?"+where+" FOR UPDATE",
+			args...).Scan(&email, &isPrimary); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidAccount
+			}
+			return err
+		}
+		if isPrimary {
+			return ErrAlreadyPrimary
+		}
+		if email == "" {
+			return ErrNoAccountEmail
+		}
+
+		for _, table := range authTables() {
+			if _, err := t.Exec(
+				"UPDATE "+table+" SET is_primary=0 WHERE member_id=?",
+				m.id); err != nil {
+				return err
+			}
+		}
+		if _, err := t.Exec(
+			"UPDATE "+a.name+" SET is_primary=1 WHERE member_id=?"+where,
+			args...); err != nil {
+			return err
+		}
+		_, err := t.Exec(
+			"UPDATE "+memberTable+" SET email=? WHERE id=?",
+			email, m.id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	m.Email = email
+	return nil
+}
+
+// RemoveAccount stops the member from signing in with one of their accounts.
+// The primary account can't be removed; make another one primary first.
+func (m *Member) RemoveAccount(provider string) error {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return err
+	}
+
+	a, err := accountTableFor(provider)
+	if err != nil {
+		return err
+	}
+	where, args := a.scope()
+	args = append([]interface{}{m.id}, args...)
+
+	return inTx(func(t *sql.Tx) error {
+
+		var isPrimary bool
+		if err := t.QueryRow(
+			"SELECT is_primary FROM "+a.name+" WHERE member_id=?"+where+" FOR UPDATE",
+			args...).Scan(&isPrimary); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidAccount
+			}
+			return err
+		}
+		if isPrimary {
+			return ErrCantRemovePrimary
+		}
+
+		if _, err := t.Exec(
+			"DELETE FROM "+a.name+" WHERE member_id=?"+where,
+			args...); err != nil {
+			return err
+		}
+		if a.name != emailAuthTable {
+			return nil
+		}
+		// Outstanding reset links are no use now.
+		_, err := t.Exec(
+			"DELETE FROM "+passwordResetTable+" WHERE member_id=?",
+			m.id)
+		return err
+	})
+}
@@ -0,0 +1,35 @@
+package sso
+
+import "testing"
+
+// Type tableProvider is a custom provider with its own auth table.
+type tableProvider struct{ name, table string }
+
+func (p tableProvider) Name() string                     { return p.name }
+func (p tableProvider) Table() string                    { return p.table }
+func (p tableProvider) Verify(string) (*Identity, error) { return nil, ErrInvalidItoken }
+
+func TestAuthTables(t *testing.T) {
+
+	RegisterProvider(tableProvider{"test-custom", "app_auth_custom"})
+	RegisterProvider(tableProvider{"test-google", googleAuthTable})
+	defer func() {
+		providersMu.Lock()
+		delete(providers, "test-custom")
+		delete(providers, "test-google")
+		providersMu.Unlock()
+	}()
+
+	count := make(map[string]int)
+	for _, table := range authTables() {
+		count[table]++
+	}
+	for _, table := range append(builtinAuthTables, "app_auth_custom") {
+		if count[table] != 1 {
+			t.Errorf("%s: listed %d times", table, count[table])
+		}
+	}
+	if len(count) != len(builtinAuthTables)+1 {
+		t.Errorf("got %v", count)
+	}
+}
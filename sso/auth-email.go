@@ -2,60 +2,119 @@ package sso
 
 import (
 	"database/sql"
-	"golang.org/x/crypto/bcrypt"
+	"log"
 	"strings"
 )
 
 // AutheEmail verifies an email/password combination and returns the id
 // of the associated member record.
-func AuthEmail(email, pw string) (int64, error) {
+//
+// If the password was hashed with other than the current PasswordHasher, it
+// is rehashed while we have it.
+//
+// Failures are counted against both the email address and ip, the client's
+// IP address; once either has too many, AuthEmail returns a *LockoutError
+// without checking the password at all.
+func AuthEmail(email, pw, ip string) (int64, error) {
+
+	if Lockout != nil {
+		if err := Lockout.check(accountKey(email), ipKey(ip)); err != nil {
+			return 0, err
+		}
+	}
 
 	var mid int64
-	var pwhash []byte
+	var pwhash string
 
 	if err := db.QueryRow(
 		"SELECT member_id, pwhash FROM "+emailAuthTable+" WHERE email=?",
 		email).Scan(&mid, &pwhash); err != nil {
 		if err == sql.ErrNoRows {
+			authFailed(email, ip)
 			return 0, ErrAuthenticationFailure
 		}
 		return 0, err
 	}
 
-	err := bcrypt.CompareHashAndPassword(pwhash, []byte(pw))
+	ok, rehash, err := verifyPassword(pwhash, pw)
 	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		authFailed(email, ip)
 		return 0, ErrAuthenticationFailure
 	}
+	if Lockout != nil {
+		Lockout.succeed(email)
+	}
+
+	if rehash {
+		// Failing to upgrade the hash is no reason to fail the signin.
+		if newhash, err := hashPassword(pw); err != nil {
+			log.Println(err)
+		} else if _, err := db.Exec(
+			"UPDATE "+emailAuthTable+" SET pwhash=? WHERE member_id=? AND pwhash=?",
+			newhash, mid, pwhash); err != nil {
+			log.Println(err)
+		}
+	}
 
 	return mid, nil
 }
 
+// authFailed records a failed attempt for AuthEmail.
+func authFailed(email, ip string) {
+	if Lockout != nil {
+		Lockout.fail(email, ip)
+	}
+}
+
 // GenerateVcode creates a unique token that maps back to the specified email
 // address.  Send this token as part of a link in a confirmation email, and
 // use GetVerifiedEmail to change it back into a (now verified) email address.
 func GenerateVcode(email string) (string, error) {
 
-	// Check only the very basic email format. The real validation happens when
-	// we actually send to the email address. This will allow  unconventional
-	// email addresses to still be used.
-	if strings.Count(email, "@") != 1 || email[0] == '@' || email[len(email)-1] == '@' {
+	if !plausibleEmail(email) {
 		return "", ErrInvalidEmail
 	}
 
-  // Have the verify code be valid for 24 hours.
-	expiry := timestamp() + 86400
+	// Have the verify code be valid for 24 hours.
+	return newVerifyToken(email, purposeRegister, 86400)
+}
+
+// plausibleEmail checks only the very basic email format. The real validation
+// happens when we actually send to the email address. This will allow
+// unconventional email addresses to still be used, but not line breaks, which
+// would let the address add headers to the email.
+func plausibleEmail(email string) bool {
+	return strings.Count(email, "@") == 1 && email[0] != '@' && email[len(email)-1] != '@' &&
+		!strings.ContainsAny(email, "\r\n")
+}
+
+// Purposes of the tokens in the email verify table.  Tokens for one purpose
+// can't be used for another.
+const (
+	purposeRegister = "register"
+	purposeSignin   = "signin"
+)
+
+// newVerifyToken stores and returns a token that proves ownership of an email
+// address, for the given purpose, valid for lifetime seconds.
+func newVerifyToken(email, purpose string, lifetime int64) (string, error) {
+
+	expiry := timestamp() + lifetime
 
 	for {
-		vcode := RandomToken(32)
+		vtoken := RandomToken(32)
 		if _, err := db.Exec(
-			"INSERT INTO "+emailVerifyTable+" (vtoken, email, expires_at) VALUES (?,?,?)",
-			vcode, email, expiry); err != nil {
+			"INSERT INTO "+emailVerifyTable+" (vtoken, email, purpose, expires_at) VALUES (?,?,?,?)",
+			vtoken, email, purpose, expiry); err != nil {
 			if isDuplicate(err) {
 				continue
 			}
 			return "", err
 		}
-		return vcode, nil
+		return vtoken, nil
 	}
 }
 
@@ -74,8 +133,8 @@ func GetVerifiedEmail(vcode string) (string, error) {
 	now := timestamp()
 
 	if err := db.QueryRow(
-		"SELECT email, expires_at FROM "+emailVerifyTable+" WHERE vtoken=?",
-		vcode, now).Scan(&email, &expiry); err != nil {
+		"SELECT email, expires_at FROM "+emailVerifyTable+" WHERE vtoken=? AND purpose=?",
+		vcode, purposeRegister).Scan(&email, &expiry); err != nil {
 		if err == sql.ErrNoRows {
 			return "", ErrInvalidVerifyCode
 		}
@@ -96,29 +155,18 @@ func GetVerifiedEmail(vcode string) (string, error) {
 }
 
 // addEmailAuth creates a new email auth record and points it to an existing
-// member record.
-func addEmailAuth(email, pw string, mid int64, isPrimary bool) (err error) {
-
-	t, err := db.Begin()
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err == nil {
-			t.Rollback()
-		} else {
-			t.Commit()
-		}
-	}()
+// member record.  Call it inside a transaction along with whatever else needs
+// to happen at the same time.  The password should already have been checked
+// against PasswordRules.
+func addEmailAuth(ex execer, email, pw string, mid int64, isPrimary bool) error {
 
-	pwhash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	pwhash, err := hashPassword(pw)
 	if err != nil {
 		return err
 	}
 
-	if _, err := t.Exec(
-		"INSERT INTO "+emailAuthTable+" (member_id, email, pwhash, pwchanged_at, is_primary) VALUES (?, ?, ?, ?)",
+	if _, err := ex.Exec(
+		"INSERT INTO "+emailAuthTable+" (member_id, email, pwhash, pwchanged_at, is_primary) VALUES (?, ?, ?, ?, ?)",
 		mid, email, pwhash, timestamp(), isPrimary); err != nil {
 		if isDuplicate(err) {
 			return ErrDuplicateEmail
@@ -127,7 +175,7 @@ func addEmailAuth(email, pw string, mid int64, isPrimary bool) (err error) {
 	}
 
 	if isPrimary && email != "" {
-		if _, err := t.Exec(
+		if _, err := ex.Exec(
 			"UPDATE "+memberTable+" SET email=? WHERE id=?",
 			email, mid); err != nil {
 			return err
@@ -0,0 +1,97 @@
+package sso
+
+import "database/sql"
+
+// AuthSocial validates an id token from a social network and returns the id
+// of the associated member record.  nonce is the one from NewNonce that the
+// token was requested with, or "" for providers that don't use nonces.
+//
+// If the social account isn't known yet, a brand new member is created for
+// it.  It's never linked to an existing member by email address, since that
+// would let whoever controls a provider account with the same address take
+// over the member; members link accounts themselves with AddSocialAccount.
+func AuthSocial(provider, idToken, nonce string) (int64, error) {
+
+	p, id, err := verifySocial(provider, idToken, nonce)
+	if err != nil {
+		return 0, err
+	}
+	return authIdentity(p, id)
+}
+
+// authIdentity returns the member that a verified identity from p belongs
+// to, creating one if need be.
+func authIdentity(p Provider, id *Identity) (int64, error) {
+
+	a := tableFor(p)
+
+	mid, err := a.find(id.Uid)
+	if err != sql.ErrNoRows {
+		return mid, err
+	}
+
+	err = inTx(func(t *sql.Tx) error {
+		var err error
+		mid, err = createMember(t, id.Email, id.FullName, id.ShortName)
+		if err != nil {
+			return err
+		}
+		return a.link(t, mid, id, true)
+	})
+
+	return mid, err
+}
+
+// Type accountTable locates the accounts of one provider.
+type accountTable struct {
+	name   string // auth table
+	issuer string // "" unless the provider is a ScopedProvider
+}
+
+// tableFor returns where the provider's accounts are stored.
+func tableFor(p Provider) accountTable {
+	a := accountTable{name: p.Table()}
+	if sp, ok := p.(ScopedProvider); ok {
+		a.issuer = sp.Issuer()
+	}
+	return a
+}
+
+// scope returns an extra condition, with its arguments, that picks out this
+// provider's rows in a shared table.
+func (a accountTable) scope() (string, []interface{}) {
+	if a.issuer == "" {
+		return "", nil
+	}
+	return " AND issuer=?", []interface{}{a.issuer}
+}
+
+// find returns the member linked to the account with the given uid, or
+// sql.ErrNoRows if there isn't one.
+func (a accountTable) find(uid string) (int64, error) {
+	var mid int64
+	where, args := a.scope()
+	err := db.QueryRow(
+		"SELECT member_id FROM "+a.name+" WHERE uid=?"+where,
+		append([]interface{}{uid}, args...)...).Scan(&mid)
+	return mid, err
+}
+
+// link adds an account record pointing to an existing member.
+func (a accountTable) link(ex execer, mid int64, id *Identity, isPrimary bool) error {
+
+	var err error
+	if a.issuer == "" {
+		_, err = ex.Exec(
+			"INSERT INTO "+a.name+" (member_id, uid, email, is_primary) VALUES (?,?,?,?)",
+			mid, id.Uid, id.Email, isPrimary)
+	} else {
+		_, err = ex.Exec(
+			"INSERT INTO "+a.name+" (member_id, issuer, uid, email, is_primary) VALUES (?,?,?,?,?)",
+			mid, a.issuer, id.Uid, id.Email, isPrimary)
+	}
+	if isDuplicate(err) {
+		return ErrDuplicateAccount
+	}
+	return err
+}
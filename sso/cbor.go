@@ -0,0 +1,163 @@
+package sso
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// errCBOR is returned for CBOR that we can't decode.
+var errCBOR = errors.New("invalid or unsupported CBOR")
+
+// cborMaxDepth limits how deeply arrays and maps may nest.
+const cborMaxDepth = 16
+
+// cborDecode decodes the CBOR item (RFC 7049) at the start of b and returns
+// it along with whatever follows it.  It only supports what WebAuthn needs:
+//
+//	unsigned and negative integers  int64
+//	byte strings                    []byte
+//	text strings                    string
+//	arrays                          []interface{}
+//	maps                            map[interface{}]interface{}
+//	false, true, null               bool, nil
+//	floats                          float64
+//
+// Tags are skipped over.  Indefinite lengths aren't supported, since
+// authenticators must use canonical CBOR.
+func cborDecode(b []byte) (interface{}, []byte, error) {
+	return cborItem(b, 0)
+}
+
+func cborItem(b []byte, depth int) (interface{}, []byte, error) {
+
+	if depth > cborMaxDepth || len(b) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	// Simple values and floats keep their argument in info.
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		}
+	}
+
+	// Everything else has an argument: a value, a length or a count.
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(b) >= 1:
+		arg, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		arg, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		arg, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		arg, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, errCBOR
+	}
+
+	switch major {
+
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(arg), b, nil
+
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(arg), b, nil
+
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		s := b[:arg]
+		if major == 3 {
+			return string(s), b[arg:], nil
+		}
+		return append([]byte(nil), s...), b[arg:], nil
+
+	case 4:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		a := make([]interface{}, arg)
+		for i := range a {
+			var err error
+			if a[i], b, err = cborItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return a, b, nil
+
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, rest, err := cborItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			if m[k], b, err = cborItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, b, nil
+
+	case 6:
+		return cborItem(b, depth+1)
+
+	case 7:
+		switch info {
+		case 25:
+			return halfFloat(uint16(arg)), b, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), b, nil
+		case 27:
+			return math.Float64frombits(arg), b, nil
+		}
+	}
+	return nil, nil, errCBOR
+}
+
+// halfFloat converts an IEEE 754 half-precision float.
+func halfFloat(h uint16) float64 {
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,210 @@
+package sso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// cborEncode encodes v as canonical CBOR, for tests that need to play the
+// authenticator.  It handles what cborDecode does, except floats; map keys
+// are sorted as CTAP2 requires.
+func cborEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		return cborEncode(int64(v))
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		b := cborHead(4, uint64(len(v)))
+		for _, x := range v {
+			b = append(b, cborEncode(x)...)
+		}
+		return b
+	case map[interface{}]interface{}:
+		type pair struct{ k, v []byte }
+		pairs := make([]pair, 0, len(v))
+		for k, x := range v {
+			pairs = append(pairs, pair{cborEncode(k), cborEncode(x)})
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			a, b := pairs[i].k, pairs[j].k
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return bytes.Compare(a, b) < 0
+		})
+		b := cborHead(5, uint64(len(v)))
+		for _, p := range pairs {
+			b = append(append(b, p.k...), p.v...)
+		}
+		return b
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+	panic("cborEncode: unsupported type")
+}
+
+// cborHead encodes the initial byte and argument of a CBOR item.
+func cborHead(major byte, arg uint64) []byte {
+	m := major << 5
+	switch {
+	case arg < 24:
+		return []byte{m | byte(arg)}
+	case arg <= math.MaxUint8:
+		return []byte{m | 24, byte(arg)}
+	case arg <= math.MaxUint16:
+		b := []byte{m | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(arg))
+		return b
+	case arg <= math.MaxUint32:
+		b := []byte{m | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(arg))
+		return b
+	}
+	b := []byte{m | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], arg)
+	return b
+}
+
+// Examples from RFC 7049, appendix A.
+func TestCBORDecode(t *testing.T) {
+
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f7", nil},
+		{"f90000", 0.0},
+		{"f93c00", 1.0},
+		{"f9c400", -4.0},
+		{"f97bff", 65504.0},
+		{"f90001", 5.960464477539063e-8},
+		{"f97c00", math.Inf(1)},
+		{"fa47c35000", 100000.0},
+		{"fb3ff199999999999a", 1.1},
+		{"40", []byte(nil)},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"62c3bc", "ü"},
+		{"80", []interface{}{}},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a0", map[interface{}]interface{}{}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"c11a514b67b0", int64(1363896240)}, // tags are skipped
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.hex)
+		got, rest, err := cborDecode(b)
+		if err != nil || len(rest) != 0 {
+			t.Errorf("%s: got %v, rest %x", tt.hex, err, rest)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.hex, got, tt.want)
+		}
+	}
+
+	nan, _, err := cborDecode([]byte{0xf9, 0x7e, 0x00})
+	if f, ok := nan.(float64); err != nil || !ok || !math.IsNaN(f) {
+		t.Errorf("NaN: got %v, %v", nan, err)
+	}
+
+	// Whatever follows the item is passed back.
+	if _, rest, err := cborDecode([]byte{0x01, 0x02, 0x03}); err != nil || !bytes.Equal(rest, []byte{0x02, 0x03}) {
+		t.Errorf("rest: got %x, %v", rest, err)
+	}
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	v := map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": bytes.Repeat([]byte{0xab}, 300),
+		int64(-3):  []interface{}{int64(-70000), int64(1) << 40, true, nil, "x"},
+	}
+	got, rest, err := cborDecode(cborEncode(v))
+	if err != nil || len(rest) != 0 || !reflect.DeepEqual(got, v) {
+		t.Errorf("got %#v, %v", got, err)
+	}
+}
+
+func TestCBORMalformed(t *testing.T) {
+
+	tests := map[string]string{
+		"empty":                     "",
+		"missing 1-byte argument":   "18",
+		"missing 2-byte argument":   "1903",
+		"missing 4-byte argument":   "1a000f42",
+		"missing 8-byte argument":   "1b000000e8d4a510",
+		"reserved argument":         "1c",
+		"indefinite byte string":    "5f",
+		"indefinite array":          "9f",
+		"indefinite map":            "bf",
+		"uint too big":              "1bffffffffffffffff",
+		"negative int too big":      "3bffffffffffffffff",
+		"byte string too long":      "44010203",
+		"text string too long":      "64494554",
+		"huge byte string":          "5bffffffffffffffff",
+		"array too long":            "830102",
+		"huge array":                "9bffffffffffffffff",
+		"map missing value":         "a101",
+		"map too long":              "a2010203",
+		"huge map":                  "bbffffffffffffffff",
+		"array key":                 "a1800102",
+		"byte string key":           "a1410102",
+		"tag with nothing":          "c1",
+		"unassigned simple value":   "f0",
+		"one-byte simple value":     "f820",
+		"break outside indefinite":  "ff",
+		"truncated item in array":   "82011903",
+		"truncated item in map key": "a119",
+	}
+	for name, h := range tests {
+		b, _ := hex.DecodeString(h)
+		if v, _, err := cborDecode(b); err == nil {
+			t.Errorf("%s: got %#v", name, v)
+		}
+	}
+
+	// Nesting is limited, so that a small input can't use up the stack.
+	deep := append(bytes.Repeat([]byte{0x81}, cborMaxDepth+1), 0x00)
+	if _, _, err := cborDecode(deep); err == nil {
+		t.Error("too deep: no error")
+	}
+	ok := append(bytes.Repeat([]byte{0x81}, cborMaxDepth), 0x00)
+	if _, _, err := cborDecode(ok); err != nil {
+		t.Errorf("deep enough: %v", err)
+	}
+}
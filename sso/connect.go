@@ -1,19 +1,71 @@
 package sso
 
-// Type ConnectReply is returned from the connect functions.
+import "net/http"
+
+// Type ConnectReply is returned from the connect functions.  As with
+// SigninReply, members with two-factor authentication first get an Mtoken,
+// for ConnectMFA.
 type ConnectReply struct {
-	Atoken string  `json:"atoken"`
-	Member *Member `json:"member"`
+	Atoken        string   `json:"atoken,omitempty"`
+	Mtoken        string   `json:"mtoken,omitempty"`
+	MtokenExpires int64    `json:"mtoken_expires,omitempty"`
+	MfaMethods    []string `json:"mfa_methods,omitempty"`
+	Member        *Member  `json:"member,omitempty"`
 }
 
 // ConnectEmail validates an email/password combination and returns an
 // auth token (for use in the Authorization header).
-func ConnectEmail(email, password string) (*ConnectReply, error) {
-	return &ConnectReply{}, nil
+func ConnectEmail(r *http.Request, email, password string) (*ConnectReply, error) {
+	mid, err := AuthEmail(email, password, ClientIP(r))
+	if err != nil {
+		return nil, err
+	}
+	return startConnection(r, mid)
 }
 
 // ConnectSocial validates an id token from a social network and returns
-// an auth token (for use in the Authorization header).
-func ConnectSocial(provider, id_token string) (*ConnectReply, error) {
-	return &ConnectReply{}, nil
+// an auth token (for use in the Authorization header).  See AuthSocial
+// regarding the nonce.
+func ConnectSocial(r *http.Request, provider, id_token, nonce string) (*ConnectReply, error) {
+	mid, err := AuthSocial(provider, id_token, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return startConnection(r, mid)
+}
+
+// startConnection gives an already-authenticated member a new token-based
+// session.  Unlike cookie sessions, these don't come with a refresh token;
+// the token stays good until the member signs out or it times out (see
+// TokenTimeouts).  If the member has two-factor authentication, the reply
+// instead has a challenge token.
+func startConnection(r *http.Request, mid int64) (*ConnectReply, error) {
+
+	m, err := getMember(mid)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newChallenge(mid, false)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		return &ConnectReply{Mtoken: c.mtoken, MtokenExpires: c.expiry, MfaMethods: c.methods}, nil
+	}
+	return openConnection(r, m)
+}
+
+// openConnection gives a member who has been fully authenticated a new
+// token-based session.
+func openConnection(r *http.Request, m *Member) (*ConnectReply, error) {
+
+	m.signinAt = timestamp()
+	atoken, err := newActive(db, r, m, false)
+	if err != nil {
+		return nil, err
+	}
+
+	m.aToken = atoken
+	return &ConnectReply{Atoken: atoken, Member: m}, nil
 }
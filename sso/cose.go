@@ -0,0 +1,121 @@
+package sso
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithms (RFC 8152) that we accept for WebAuthn credentials, in
+// order of preference.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+var coseAlgs = []int64{coseES256, coseEdDSA, coseRS256}
+
+// errCOSE is returned for keys and signatures that we can't use.
+var errCOSE = errors.New("invalid or unsupported COSE key")
+
+// Type coseKey is a credential public key.
+type coseKey struct {
+	alg int64
+	pub crypto.PublicKey
+}
+
+// parseCOSEKey decodes the COSE_Key at the start of b and returns it along
+// with whatever follows it.
+func parseCOSEKey(b []byte) (*coseKey, []byte, error) {
+
+	v, rest, err := cborDecode(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errCOSE
+	}
+
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	k := &coseKey{alg: alg}
+
+	switch {
+	case kty == 2 && alg == coseES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, nil, errCOSE
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, nil, errCOSE
+		}
+		k.pub = pub
+
+	case kty == 1 && alg == coseEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, nil, errCOSE
+		}
+		k.pub = ed25519.PublicKey(x)
+
+	case kty == 3 && alg == coseRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, nil, errCOSE
+		}
+		k.pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	default:
+		return nil, nil, errCOSE
+	}
+
+	return k, rest, nil
+}
+
+// verify checks a signature over data made with the key's algorithm.
+func (k *coseKey) verify(data, sig []byte) bool {
+	return verifySig(k.alg, k.pub, data, sig)
+}
+
+// verifySig checks a signature made with a COSE algorithm.  ECDSA signatures
+// are ASN.1 encoded, as WebAuthn requires.
+func verifySig(alg int64, pub crypto.PublicKey, data, sig []byte) bool {
+
+	sum := sha256.Sum256(data)
+
+	switch alg {
+
+	case coseES256:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		var rs struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) > 0 {
+			return false
+		}
+		return ecdsa.Verify(key, sum[:], rs.R, rs.S)
+
+	case coseEdDSA:
+		key, ok := pub.(ed25519.PublicKey)
+		return ok && ed25519.Verify(key, data, sig)
+
+	case coseRS256:
+		key, ok := pub.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package sso
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+// coseKeyMap returns the COSE_Key for a public key, as a map for tests to
+// spoil before encoding.
+func coseKeyMap(pub crypto.PublicKey) map[interface{}]interface{} {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		return map[interface{}]interface{}{
+			int64(1): int64(2), int64(3): int64(coseES256), int64(-1): int64(1),
+			int64(-2): pub.X.FillBytes(make([]byte, 32)),
+			int64(-3): pub.Y.FillBytes(make([]byte, 32)),
+		}
+	case ed25519.PublicKey:
+		return map[interface{}]interface{}{
+			int64(1): int64(1), int64(3): int64(coseEdDSA), int64(-1): int64(6),
+			int64(-2): []byte(pub),
+		}
+	case *rsa.PublicKey:
+		return map[interface{}]interface{}{
+			int64(1): int64(3), int64(3): int64(coseRS256),
+			int64(-1): pub.N.Bytes(),
+			int64(-2): big.NewInt(int64(pub.E)).Bytes(),
+		}
+	}
+	panic("coseKeyMap: unsupported key")
+}
+
+// coseSign signs data the way an authenticator with the key would.
+func coseSign(t *testing.T, priv crypto.Signer, data []byte) []byte {
+	t.Helper()
+	var (
+		sig []byte
+		err error
+	)
+	if k, ok := priv.(ed25519.PrivateKey); ok {
+		return ed25519.Sign(k, data)
+	}
+	sum := sha256.Sum256(data)
+	switch k := priv.(type) {
+	case *ecdsa.PrivateKey:
+		sig, err = ecdsa.SignASN1(rand.Reader, k, sum[:])
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// testSigners returns a key for each algorithm we accept.
+func testSigners(t *testing.T) map[string]crypto.Signer {
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"ES256": ec, "EdDSA": ed, "RS256": testKey(t, "a")}
+}
+
+func TestCOSEKeys(t *testing.T) {
+
+	data := []byte("authenticator data and client data hash")
+
+	for name, priv := range testSigners(t) {
+		raw := cborEncode(coseKeyMap(priv.Public()))
+		k, rest, err := parseCOSEKey(append(raw, 0xff))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(rest) != 1 {
+			t.Errorf("%s: rest %x", name, rest)
+		}
+
+		sig := coseSign(t, priv, data)
+		if !k.verify(data, sig) {
+			t.Errorf("%s: good signature rejected", name)
+		}
+		if k.verify([]byte("something else"), sig) {
+			t.Errorf("%s: signature over other data accepted", name)
+		}
+		bad := append([]byte(nil), sig...)
+		bad[len(bad)/2] ^= 1
+		if k.verify(data, bad) {
+			t.Errorf("%s: spoilt signature accepted", name)
+		}
+		if k.verify(data, nil) {
+			t.Errorf("%s: no signature accepted", name)
+		}
+	}
+}
+
+func TestCOSESignatureAlgorithm(t *testing.T) {
+
+	signers := testSigners(t)
+	data := []byte("data")
+
+	// A signature must be checked with the algorithm the key is for.
+	ec := signers["ES256"].Public()
+	if verifySig(coseRS256, ec, data, coseSign(t, signers["ES256"], data)) {
+		t.Error("ES256 key used as RS256")
+	}
+	if verifySig(coseEdDSA, ec, data, coseSign(t, signers["ES256"], data)) {
+		t.Error("ES256 key used as EdDSA")
+	}
+	if verifySig(-999, ec, data, coseSign(t, signers["ES256"], data)) {
+		t.Error("unknown algorithm accepted")
+	}
+
+	// ECDSA signatures must be exactly one ASN.1 sequence.
+	sig := append(coseSign(t, signers["ES256"], data), 0)
+	if verifySig(coseES256, ec, data, sig) {
+		t.Error("ECDSA signature with trailing data accepted")
+	}
+}
+
+func TestCOSEKeyMalformed(t *testing.T) {
+
+	signers := testSigners(t)
+	ec := coseKeyMap(signers["ES256"].Public())
+	ed := coseKeyMap(signers["EdDSA"].Public())
+	rs := coseKeyMap(signers["RS256"].Public())
+
+	// with returns a copy of m with key k set to v, or removed if v is nil.
+	with := func(m map[interface{}]interface{}, k int64, v interface{}) map[interface{}]interface{} {
+		c := make(map[interface{}]interface{})
+		for kk, vv := range m {
+			c[kk] = vv
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]interface{}{
+		"not a map":          []interface{}{int64(1)},
+		"no kty":             with(ec, 1, nil),
+		"no alg":             with(ec, 3, nil),
+		"kty doesn't match":  with(ec, 1, int64(3)),
+		"unknown alg":        with(ec, 3, int64(-35)),
+		"EC wrong curve":     with(ec, -1, int64(2)),
+		"EC short x":         with(ec, -2, make([]byte, 31)),
+		"EC no y":            with(ec, -3, nil),
+		"EC not on curve":    with(ec, -3, make([]byte, 32)),
+		"EdDSA wrong curve":  with(ed, -1, int64(7)),
+		"EdDSA short key":    with(ed, -2, make([]byte, 31)),
+		"RSA key too small":  coseKeyMap(&small.PublicKey),
+		"RSA no exponent":    with(rs, -2, []byte{}),
+		"RSA huge exponent":  with(rs, -2, []byte{1, 0, 0, 0, 1}),
+		"RSA n not bytes":    with(rs, -1, "n"),
+		"EC x not bytes":     with(ec, -2, int64(1)),
+		"alg not an integer": with(ec, 3, "ES256"),
+	}
+	for name, m := range tests {
+		if _, _, err := parseCOSEKey(cborEncode(m)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	raw := cborEncode(ec)
+	for i := 0; i < len(raw); i++ {
+		if _, _, err := parseCOSEKey(raw[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: no error", i)
+		}
+	}
+}
@@ -9,13 +9,27 @@ import (
 // Names of tables in the database that are used by this package.
 // This package does not create the tables; see mysql/schema.sql.
 const (
-	memberTable       = "fsso_members"
-	emailAuthTable    = "fsso_auth_email"
-	googleAuthTable   = "fsso_auth_goo"
-	facebookAuthTable = "fsso_auth_fb"
-	activeTable       = "fsso_active"
-	refreshTable      = "fsso_refresh"
-	emailVerifyTable  = "fsso_email_verify"
+	memberTable            = "fsso_members"
+	emailAuthTable         = "fsso_auth_email"
+	failureTable           = "fsso_auth_failures"
+	googleAuthTable        = "fsso_auth_goog"
+	facebookAuthTable      = "fsso_auth_fb"
+	webauthnAuthTable      = "fsso_auth_webauthn"
+	oidcAuthTable          = "fsso_auth_oidc"
+	activeTable            = "fsso_active"
+	refreshTable           = "fsso_refresh"
+	refreshUsedTable       = "fsso_refresh_used"
+	totpTable              = "fsso_mfa_totp"
+	recoveryTable          = "fsso_mfa_recovery"
+	mfaChallengeTable      = "fsso_mfa_challenge"
+	webauthnChallengeTable = "fsso_webauthn_challenge"
+	emailVerifyTable       = "fsso_email_verify"
+	passwordResetTable     = "fsso_password_reset"
+	oauthStateTable        = "fsso_oauth_state"
+	nonceTable             = "fsso_nonce"
+	oidcClientTable        = "fsso_oidc_clients"
+	oidcCodeTable          = "fsso_oidc_codes"
+	oidcTokenTable         = "fsso_oidc_tokens"
 )
 
 var db *sql.DB
@@ -35,6 +49,20 @@ func InitDB(dsn string) {
 	db = d
 }
 
+// inTx runs f inside a transaction.  The transaction is committed if f
+// returns nil and rolled back otherwise.
+func inTx(f func(*sql.Tx) error) error {
+	t, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(t); err != nil {
+		t.Rollback()
+		return err
+	}
+	return t.Commit()
+}
+
 // isDuplicate tests err to see if a db error is a unique constraint violation
 func isDuplicate(err error) bool {
 	if err0, ok := err.(*mysql.MySQLError); ok {
@@ -0,0 +1,70 @@
+package sso
+
+import "database/sql"
+
+// DeletionGracePeriod is the number of seconds between a member asking for
+// their account to be deleted and it actually being deleted.  Signing in
+// during that time cancels the deletion.  The janitor does the actual
+// deleting (see RunJanitor).
+var DeletionGracePeriod int64 = 30 * 86400
+
+// DeleteWithPassword schedules the member's account for deletion, after
+// checking their password.  sure must be true, to show that the member
+// confirmed it.  Returns the time at which the account will be deleted.
+func (m *Member) DeleteWithPassword(password string, sure bool) (int64, error) {
+
+	if !sure {
+		return 0, ErrYoureNotSure
+	}
+
+	if err := m.checkPassword(password); err != nil {
+		return 0, err
+	}
+
+	return m.scheduleDeletion()
+}
+
+// DeleteWithSocial is like DeleteWithPassword, for members who reauthenticate
+// with a fresh id token from one of their social network accounts.  See
+// AuthSocial regarding the nonce.
+func (m *Member) DeleteWithSocial(provider, idToken, nonce string, sure bool) (int64, error) {
+
+	if !sure {
+		return 0, ErrYoureNotSure
+	}
+
+	if err := m.checkSocial(provider, idToken, nonce); err != nil {
+		return 0, err
+	}
+
+	return m.scheduleDeletion()
+}
+
+// scheduleDeletion marks the member for deletion once the grace period is
+// up, and signs them out everywhere.
+func (m *Member) scheduleDeletion() (int64, error) {
+
+	deleteAt := timestamp() + DeletionGracePeriod
+
+	err := inTx(func(t *sql.Tx) error {
+		if _, err := t.Exec(
+			"UPDATE "+memberTable+" SET delete_at=? WHERE id=?",
+			deleteAt, m.id); err != nil {
+			return err
+		}
+		return revokeMember(t, m.id)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleteAt, nil
+}
+
+// cancelDeletion takes the member off the list for deletion, if they were
+// on it.  It's called whenever the member signs in.
+func cancelDeletion(ex execer, mid int64) error {
+	_, err := ex.Exec(
+		"UPDATE "+memberTable+" SET delete_at=0 WHERE id=? AND delete_at<>0",
+		mid)
+	return err
+}
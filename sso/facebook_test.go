@@ -0,0 +1,111 @@
+package sso
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Type fakeGraph stands in for the parts of the Graph API that
+// FacebookProvider uses.
+type fakeGraph struct {
+	appID, secret string
+	token         string // the only good access token
+	tokenApp      string // the app the token was issued to
+	expiresAt     int64
+	meID          string
+}
+
+func (g *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/debug_token":
+		if q.Get("access_token") != g.appID+"|"+g.secret {
+			http.Error(w, `{"error":{}}`, http.StatusBadRequest)
+			return
+		}
+		var d map[string]interface{}
+		if q.Get("input_token") == g.token {
+			d = map[string]interface{}{"app_id": g.tokenApp, "is_valid": true, "expires_at": g.expiresAt, "user_id": "1234"}
+		} else {
+			d = map[string]interface{}{"is_valid": false}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": d})
+	case "/me":
+		mac := hmac.New(sha256.New, []byte(g.secret))
+		mac.Write([]byte(q.Get("access_token")))
+		if q.Get("access_token") != g.token || q.Get("appsecret_proof") != hex.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, `{"error":{}}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": g.meID, "name": "Ada Lovelace", "first_name": "Ada"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// facebookFor returns a FacebookProvider talking to g.
+func facebookFor(t *testing.T, g *fakeGraph) *FacebookProvider {
+	t.Helper()
+	srv := httptest.NewServer(g)
+	t.Cleanup(srv.Close)
+	f := NewFacebookProvider(g.appID, g.secret)
+	f.GraphURL, f.Client = srv.URL, srv.Client()
+	return f
+}
+
+func TestFacebookVerify(t *testing.T) {
+
+	good := func() *fakeGraph {
+		return &fakeGraph{appID: "app", secret: "secret", token: "token", tokenApp: "app", meID: "1234"}
+	}
+
+	id, err := facebookFor(t, good()).Verify("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Uid != "1234" || id.FullName != "Ada Lovelace" || id.ShortName != "Ada" || id.Email != "" {
+		t.Errorf("got %+v", id)
+	}
+
+	tests := map[string]struct {
+		spoil func(*fakeGraph)
+		token string
+	}{
+		"invalid token": {func(*fakeGraph) {}, "other"},
+		"other app":     {func(g *fakeGraph) { g.tokenApp = "evil" }, "token"},
+		"expired":       {func(g *fakeGraph) { g.expiresAt = timestamp() - 60 }, "token"},
+		"other user":    {func(g *fakeGraph) { g.meID = "5678" }, "token"},
+		"wrong secret":  {func(g *fakeGraph) { g.secret = "other" }, "token"},
+	}
+	for name, test := range tests {
+		g := good()
+		f := facebookFor(t, g)
+		test.spoil(g)
+		if _, err := f.Verify(test.token); err != ErrInvalidItoken {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestFacebookDown(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	f := NewFacebookProvider("app", "secret")
+	if f.Client != defaultClient {
+		t.Error("client has no timeout")
+	}
+	f.GraphURL, f.Client = srv.URL, srv.Client()
+
+	// The provider being down isn't the token's fault.
+	if _, err := f.Verify("token"); err == nil || err == ErrInvalidItoken {
+		t.Errorf("got %v", err)
+	}
+}
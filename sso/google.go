@@ -0,0 +1,81 @@
+package sso
+
+// Google's endpoints.  GoogleJWKSURL is where Google publishes the keys it
+// signs ID tokens with.
+const (
+	GoogleJWKSURL  = "https://www.googleapis.com/oauth2/v3/certs"
+	GoogleAuthURL  = "https://accounts.google.com/o/oauth2/v2/auth"
+	GoogleTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// Type GoogleProvider verifies Google ID tokens.  ClientSecret is only needed
+// for the authorization code flow.
+type GoogleProvider struct {
+	ClientID     string    // OAuth client id of this application
+	ClientSecret string    // OAuth client secret of this application
+	Keys         KeySource // Google's signing keys
+}
+
+// NewGoogleProvider creates a GoogleProvider that fetches Google's signing
+// keys from GoogleJWKSURL.
+func NewGoogleProvider(clientID string) *GoogleProvider {
+	return &GoogleProvider{
+		ClientID: clientID,
+		Keys:     NewJWKSCache(URLJWKS(nil, GoogleJWKSURL)),
+	}
+}
+
+// Name implements Provider.
+func (g *GoogleProvider) Name() string {
+	return "google"
+}
+
+// Table implements Provider.
+func (g *GoogleProvider) Table() string {
+	return googleAuthTable
+}
+
+// OAuth implements CodeFlowProvider.
+func (g *GoogleProvider) OAuth() (*OAuthConfig, error) {
+	return &OAuthConfig{
+		AuthURL:      GoogleAuthURL,
+		TokenURL:     GoogleTokenURL,
+		ClientID:     g.ClientID,
+		ClientSecret: g.ClientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+		TokenField:   "id_token",
+	}, nil
+}
+
+// NonceClaim implements NonceProvider.
+func (g *GoogleProvider) NonceClaim() {}
+
+// Verify implements Provider.
+func (g *GoogleProvider) Verify(idToken string) (*Identity, error) {
+
+	var c idClaims
+	if err := verifyJWT(idToken, g.Keys, &c); err != nil {
+		return nil, err
+	}
+
+	if c.Iss != "accounts.google.com" && c.Iss != "https://accounts.google.com" {
+		return nil, ErrInvalidItoken
+	}
+	if !c.Aud.Contains(g.ClientID) {
+		return nil, ErrInvalidItoken
+	}
+	if c.Exp+clockSkew < timestamp() {
+		return nil, ErrInvalidItoken
+	}
+	if c.Sub == "" || c.Email == "" || !c.EmailVerified {
+		return nil, ErrInvalidItoken
+	}
+
+	return &Identity{
+		Uid:       c.Sub,
+		Email:     c.Email,
+		FullName:  c.Name,
+		ShortName: c.GivenName,
+		Nonce:     c.Nonce,
+	}, nil
+}
@@ -0,0 +1,278 @@
+package sso
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Type Hasher hashes passwords for storage.  Hashes are self-describing
+// strings that include the algorithm and its parameters, so that a hash can
+// still be checked after the configured algorithm or parameters change.
+type Hasher interface {
+
+	// Hash returns the encoded hash of pw.
+	Hash(pw string) (string, error)
+
+	// Recognizes returns true if the hash was made by this kind of hasher,
+	// whatever its parameters.
+	Recognizes(encoded string) bool
+
+	// Verify checks pw against a hash that this kind of hasher recognizes.
+	Verify(encoded, pw string) (bool, error)
+
+	// NeedsRehash returns true if a hash that this kind of hasher recognizes
+	// was made with different parameters than this hasher's.
+	NeedsRehash(encoded string) bool
+}
+
+// PasswordHasher is used to hash all new passwords.  Passwords hashed any
+// other way are rehashed with it the next time the member signs in.
+var PasswordHasher Hasher = &BcryptHasher{Cost: bcrypt.DefaultCost}
+
+// knownHashers can check hashes made by any of the supported algorithms.
+var knownHashers = []Hasher{&BcryptHasher{}, &Argon2idHasher{}, &ScryptHasher{}}
+
+// hashPassword hashes a password for storage.
+func hashPassword(pw string) (string, error) {
+	return PasswordHasher.Hash(pw)
+}
+
+// verifyPassword checks a password against a stored hash.  rehash is true if
+// the password is right but the hash should be replaced using
+// PasswordHasher.
+func verifyPassword(encoded, pw string) (ok, rehash bool, err error) {
+	if PasswordHasher.Recognizes(encoded) {
+		ok, err = PasswordHasher.Verify(encoded, pw)
+		return ok, ok && PasswordHasher.NeedsRehash(encoded), err
+	}
+	for _, h := range knownHashers {
+		if h.Recognizes(encoded) {
+			ok, err = h.Verify(encoded, pw)
+			return ok, ok, err
+		}
+	}
+	return false, false, fmt.Errorf("unrecognized password hash %.10q", encoded)
+}
+
+// Type BcryptHasher hashes passwords with bcrypt.  Note that bcrypt only uses
+// the first 72 bytes of a password.
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash implements Hasher.
+func (b *BcryptHasher) Hash(pw string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pw), b.Cost)
+	return string(h), err
+}
+
+// Recognizes implements Hasher.
+func (b *BcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2")
+}
+
+// Verify implements Hasher.
+func (b *BcryptHasher) Verify(encoded, pw string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pw))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NeedsRehash implements Hasher.
+func (b *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
+
+// Limits on the parameters of stored hashes.  They're generous, but keep a
+// corrupt or tampered hash from making a signin take unbounded time or
+// memory, and from having a key short enough to guess.
+const (
+	argon2MaxMemory  = 1 << 20 // KiB, i.e. 1 GiB
+	argon2MaxTime    = 32
+	argon2MaxThreads = 16
+	scryptMaxLogN    = 24
+	scryptMaxR       = 32
+	scryptMaxP       = 16
+	minHashKeyLen    = 16
+)
+
+// Type Argon2idHasher hashes passwords with argon2id.  Hashes are stored in
+// PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=2$salt$hash.
+type Argon2idHasher struct {
+	Time    uint32 // iterations
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+}
+
+// NewArgon2idHasher returns an Argon2idHasher with reasonable parameters.
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Time: 3, Memory: 64 * 1024, Threads: 2, KeyLen: 32}
+}
+
+// Hash implements Hasher.
+func (a *Argon2idHasher) Hash(pw string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pw), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		a.Memory, a.Time, a.Threads, b64(salt), b64(key)), nil
+}
+
+// Recognizes implements Hasher.
+func (a *Argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// decode parses an argon2id hash into its parameters, salt and key.
+func (a *Argon2idHasher) decode(encoded string) (p Argon2idHasher, salt, key []byte, err error) {
+	var version int
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, fmt.Errorf("bad argon2id hash")
+	}
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return
+	}
+	if p.Memory < 1 || p.Memory > argon2MaxMemory || p.Time < 1 || p.Time > argon2MaxTime ||
+		p.Threads < 1 || p.Threads > argon2MaxThreads {
+		return p, nil, nil, fmt.Errorf("bad argon2id parameters %s", parts[3])
+	}
+	if salt, err = unb64(parts[4]); err != nil {
+		return
+	}
+	if key, err = unb64(parts[5]); err != nil {
+		return
+	}
+	if len(key) < minHashKeyLen {
+		return p, nil, nil, fmt.Errorf("argon2id hash too short")
+	}
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// Verify implements Hasher.
+func (a *Argon2idHasher) Verify(encoded, pw string) (bool, error) {
+	p, salt, key, err := a.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(pw), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash implements Hasher.
+func (a *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := a.decode(encoded)
+	return err != nil || p != *a
+}
+
+// Type ScryptHasher hashes passwords with scrypt.  Hashes are stored in PHC
+// string format, e.g. $scrypt$ln=15,r=8,p=1$salt$hash.
+type ScryptHasher struct {
+	LogN   int // log2 of the CPU/memory cost
+	R      int
+	P      int
+	KeyLen int
+}
+
+// NewScryptHasher returns a ScryptHasher with reasonable parameters.
+func NewScryptHasher() *ScryptHasher {
+	return &ScryptHasher{LogN: 15, R: 8, P: 1, KeyLen: 32}
+}
+
+// Hash implements Hasher.
+func (s *ScryptHasher) Hash(pw string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(pw), salt, 1<<uint(s.LogN), s.R, s.P, s.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", s.LogN, s.R, s.P, b64(salt), b64(key)), nil
+}
+
+// Recognizes implements Hasher.
+func (s *ScryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$scrypt$")
+}
+
+// decode parses a scrypt hash into its parameters, salt and key.
+func (s *ScryptHasher) decode(encoded string) (p ScryptHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return p, nil, nil, fmt.Errorf("bad scrypt hash")
+	}
+	if _, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P); err != nil {
+		return
+	}
+	if p.LogN < 1 || p.LogN > scryptMaxLogN || p.R < 1 || p.R > scryptMaxR || p.P < 1 || p.P > scryptMaxP {
+		return p, nil, nil, fmt.Errorf("bad scrypt parameters %s", parts[2])
+	}
+	if salt, err = unb64(parts[3]); err != nil {
+		return
+	}
+	if key, err = unb64(parts[4]); err != nil {
+		return
+	}
+	if len(key) < minHashKeyLen {
+		return p, nil, nil, fmt.Errorf("scrypt hash too short")
+	}
+	p.KeyLen = len(key)
+	return p, salt, key, nil
+}
+
+// Verify implements Hasher.
+func (s *ScryptHasher) Verify(encoded, pw string) (bool, error) {
+	p, salt, key, err := s.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(pw), salt, 1<<uint(p.LogN), p.R, p.P, p.KeyLen)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash implements Hasher.
+func (s *ScryptHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := s.decode(encoded)
+	return err != nil || p != *s
+}
+
+// newSalt returns 16 random bytes.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// b64 and unb64 use the unpadded standard base64 of PHC strings.
+func b64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func unb64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,173 @@
+package sso
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, so that the tests don't take long.
+func testHashers() map[string]Hasher {
+	return map[string]Hasher{
+		"bcrypt":   &BcryptHasher{Cost: bcrypt.MinCost},
+		"argon2id": &Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 32},
+		"scrypt":   &ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32},
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+
+	for name, h := range testHashers() {
+		encoded, err := h.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !h.Recognizes(encoded) {
+			t.Errorf("%s: doesn't recognize %s", name, encoded)
+		}
+		if ok, err := h.Verify(encoded, "correct horse"); !ok || err != nil {
+			t.Errorf("%s: right password: %v, %v", name, ok, err)
+		}
+		if ok, err := h.Verify(encoded, "correct horsf"); ok || err != nil {
+			t.Errorf("%s: wrong password: %v, %v", name, ok, err)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("%s: own hash needs rehash", name)
+		}
+
+		// Salted, so the same password hashes differently each time.
+		if again, _ := h.Hash("correct horse"); again == encoded {
+			t.Errorf("%s: same hash twice", name)
+		}
+
+		// Only the hasher that made a hash recognizes it.
+		for other, o := range testHashers() {
+			if other != name && o.Recognizes(encoded) {
+				t.Errorf("%s recognizes %s hash", other, name)
+			}
+		}
+	}
+}
+
+func TestHashNeedsRehash(t *testing.T) {
+
+	tests := map[string][2]Hasher{
+		"bcrypt cost": {&BcryptHasher{Cost: bcrypt.MinCost}, &BcryptHasher{Cost: bcrypt.MinCost + 1}},
+		"argon2id memory": {&Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 32},
+			&Argon2idHasher{Time: 1, Memory: 128, Threads: 1, KeyLen: 32}},
+		"argon2id time": {&Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 32},
+			&Argon2idHasher{Time: 2, Memory: 64, Threads: 1, KeyLen: 32}},
+		"argon2id key length": {&Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 16},
+			&Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 32}},
+		"scrypt cost": {&ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32}, &ScryptHasher{LogN: 5, R: 8, P: 1, KeyLen: 32}},
+		"scrypt r":    {&ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32}, &ScryptHasher{LogN: 4, R: 4, P: 1, KeyLen: 32}},
+	}
+	for name, test := range tests {
+		old, now := test[0], test[1]
+		encoded, err := old.Hash("pw")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !now.NeedsRehash(encoded) {
+			t.Errorf("%s: no rehash needed", name)
+		}
+		// Hashes made with other parameters can still be checked.
+		if ok, err := now.Verify(encoded, "pw"); !ok || err != nil {
+			t.Errorf("%s: verify: %v, %v", name, ok, err)
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+
+	defer func(h Hasher) { PasswordHasher = h }(PasswordHasher)
+	hashers := testHashers()
+	PasswordHasher = hashers["argon2id"]
+
+	// Hashes made any other way are checked, and replaced if right.
+	for name, h := range hashers {
+		encoded, _ := h.Hash("pw")
+		ok, rehash, err := verifyPassword(encoded, "pw")
+		if !ok || rehash != (name != "argon2id") || err != nil {
+			t.Errorf("%s: got %v, %v, %v", name, ok, rehash, err)
+		}
+		if ok, rehash, err := verifyPassword(encoded, "wrong"); ok || rehash || err != nil {
+			t.Errorf("%s wrong password: got %v, %v, %v", name, ok, rehash, err)
+		}
+	}
+	if _, _, err := verifyPassword("plaintext", "plaintext"); err == nil {
+		t.Error("unrecognized hash: no error")
+	}
+}
+
+func TestHashBadParameters(t *testing.T) {
+
+	key := strings.Repeat("A", 43) // 32 bytes of base64
+	salt := "c2FsdHNhbHRzYWx0c2FsdA"
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=4294967295,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=255$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"$argon2id$v=18$m=64,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt,
+		"$scrypt$ln=31,r=8,p=1$" + salt + "$" + key,
+		"$scrypt$ln=15,r=1048576,p=1$" + salt + "$" + key,
+		"$scrypt$ln=15,r=8,p=0$" + salt + "$" + key,
+		"$scrypt$ln=4,r=8,p=1$" + salt + "$",
+	} {
+		// These must fail straight away, rather than trying to compute the
+		// hash with the parameters given.
+		if ok, _, err := verifyPassword(encoded, "pw"); ok || err == nil {
+			t.Errorf("%s: got %v, %v", encoded, ok, err)
+		}
+	}
+}
+
+func TestSigninRehashDB(t *testing.T) {
+	testDB(t)
+
+	defer func(h Hasher, l *LockoutPolicy) { PasswordHasher, Lockout = h, l }(PasswordHasher, Lockout)
+	Lockout = nil
+	hashers := testHashers()
+
+	// The member's password was hashed with bcrypt, and we've since moved to
+	// argon2id.
+	PasswordHasher = hashers["bcrypt"]
+	m := testMember(t)
+	if err := addEmailAuth(db, m.Email, "correct horse", m.id, false); err != nil {
+		t.Fatal(err)
+	}
+	PasswordHasher = hashers["argon2id"]
+
+	if _, err := AuthEmail(m.Email, "wrong", "192.0.2.1"); err != ErrAuthenticationFailure {
+		t.Errorf("wrong password: got %v", err)
+	}
+	if !strings.HasPrefix(storedHash(t, m), "$2") {
+		t.Error("rehashed after a wrong password")
+	}
+
+	if mid, err := AuthEmail(m.Email, "correct horse", "192.0.2.1"); err != nil || mid != m.id {
+		t.Fatalf("got %d, %v", mid, err)
+	}
+	stored := storedHash(t, m)
+	if !strings.HasPrefix(stored, "$argon2id$") || PasswordHasher.NeedsRehash(stored) {
+		t.Errorf("not rehashed: %s", stored)
+	}
+	if mid, err := AuthEmail(m.Email, "correct horse", "192.0.2.1"); err != nil || mid != m.id {
+		t.Errorf("after rehash: got %d, %v", mid, err)
+	}
+}
+
+// storedHash returns the password hash stored for m's email address.
+func storedHash(t *testing.T, m *Member) string {
+	t.Helper()
+	var h string
+	if err := db.QueryRow("SELECT pwhash FROM "+emailAuthTable+" WHERE email=?", m.Email).Scan(&h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
@@ -0,0 +1,375 @@
+package sso
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Identity provider settings.  fsso acts as an OpenID Connect provider for
+// other applications once Issuer and the signing key are set.  Issuer is the
+// URL that the endpoints are under, e.g. "https://example.com/api/auth/oidc".
+// Lifetimes are in seconds.
+var (
+	Issuer              string
+	IDTokenLifetime     int64 = 3600
+	AccessTokenLifetime int64 = 3600
+	AuthCodeLifetime    int64 = 60
+)
+
+var (
+	signingKey *rsa.PrivateKey
+	signingKid string
+)
+
+// SetSigningKey sets the private key used to sign the ID tokens we issue.
+func SetSigningKey(key *rsa.PrivateKey) {
+	sum := sha256.Sum256(key.N.Bytes())
+	signingKey = key
+	signingKid = base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// Type OAuthError is an error reported to a relying party in the format laid
+// out by OAuth2 (RFC 6749).
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e OAuthError) Error() string {
+	return e.Description
+}
+
+var (
+	ErrOAuthInvalidRequest      = OAuthError{"invalid_request", "The request is missing a parameter or is malformed."}
+	ErrOAuthInvalidClient       = OAuthError{"invalid_client", "Unknown client or bad client credentials."}
+	ErrOAuthInvalidGrant        = OAuthError{"invalid_grant", "Invalid or expired authorization code."}
+	ErrOAuthUnsupportedGrant    = OAuthError{"unsupported_grant_type", "Only authorization_code is supported."}
+	ErrOAuthUnsupportedResponse = OAuthError{"unsupported_response_type", "Only the code response type is supported."}
+	ErrOAuthInvalidScope        = OAuthError{"invalid_scope", "The openid scope is required."}
+	ErrOAuthInvalidToken        = OAuthError{"invalid_token", "Invalid or expired access token."}
+)
+
+// Type TokenReply is returned from the token endpoint.
+type TokenReply struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// RegisterClient adds an application that may sign its users in through
+// fsso.  The application may only ask for the user to be sent back to one of
+// the redirect URIs given.  Returns the new client id and secret; the secret
+// isn't stored and can't be retrieved later.
+func RegisterClient(name string, redirectURIs []string) (string, string, error) {
+
+	secret := RandomToken(32)
+	for {
+		clientID := RandomToken(24)
+		if _, err := db.Exec(
+			"INSERT INTO "+oidcClientTable+" (client_id, secret_hash, name, redirect_uris, created_at) VALUES (?,?,?,?,?)",
+			clientID, hashSecret(secret), name, strings.Join(redirectURIs, "\n"), timestamp()); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return "", "", err
+		}
+		return clientID, secret, nil
+	}
+}
+
+// hashSecret hashes a client secret or token for storage.  Our secrets are
+// long and random, so a plain hash is enough.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// getClient looks up a registered client.  Returns ErrOAuthInvalidClient if
+// there is no such client.
+func getClient(clientID string) (secretHash string, redirectURIs []string, err error) {
+	var uris string
+	if err := db.QueryRow(
+		"SELECT secret_hash, redirect_uris FROM "+oidcClientTable+" WHERE client_id=?",
+		clientID).Scan(&secretHash, &uris); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil, ErrOAuthInvalidClient
+		}
+		return "", nil, err
+	}
+	return secretHash, strings.Split(uris, "\n"), nil
+}
+
+// CheckAuthorize validates the client and redirect URI of an authorization
+// request.  Until these check out, errors must be shown to the user rather
+// than sent to the redirect URI.
+func CheckAuthorize(q url.Values) error {
+	_, uris, err := getClient(q.Get("client_id"))
+	if err != nil {
+		return err
+	}
+	for _, u := range uris {
+		if u != "" && u == q.Get("redirect_uri") {
+			return nil
+		}
+	}
+	return ErrOAuthInvalidRequest
+}
+
+// Authorize handles an authorization request from a relying party on behalf
+// of the signed-in member m, and returns the URL to send the user back to.
+// The request must already have passed CheckAuthorize.  Any other problem
+// with the request is reported to the relying party through the URL.
+func Authorize(m *Member, q url.Values) (string, error) {
+
+	redirectURI := q.Get("redirect_uri")
+	reply := url.Values{}
+	if state := q.Get("state"); state != "" {
+		reply.Set("state", state)
+	}
+
+	fail := func(e OAuthError) (string, error) {
+		reply.Set("error", e.Code)
+		reply.Set("error_description", e.Description)
+		return addQuery(redirectURI, reply), nil
+	}
+
+	if q.Get("response_type") != "code" {
+		return fail(ErrOAuthUnsupportedResponse)
+	}
+	scope := q.Get("scope")
+	if !hasWord(scope, "openid") {
+		return fail(ErrOAuthInvalidScope)
+	}
+	// PKCE is optional, but only S256 is accepted.
+	challenge := q.Get("code_challenge")
+	if challenge != "" && q.Get("code_challenge_method") != "S256" {
+		return fail(ErrOAuthInvalidRequest)
+	}
+
+	// Reauthenticating counts as authenticating, for clients that ask for a
+	// recent signin.
+	authTime := m.signinAt
+	if m.reauthAt > authTime {
+		authTime = m.reauthAt
+	}
+
+	expiry := timestamp() + AuthCodeLifetime
+	for {
+		code := RandomToken(32)
+		if _, err := db.Exec(
+			"INSERT INTO "+oidcCodeTable+" (code, client_id, member_id, is_mfa, auth_time, redirect_uri, scope, nonce, challenge, expires_at) VALUES (?,?,?,?,?,?,?,?,?,?)",
+			code, q.Get("client_id"), m.id, m.mfa, authTime, redirectURI, scope, q.Get("nonce"), challenge, expiry); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return "", err
+		}
+		reply.Set("code", code)
+		return addQuery(redirectURI, reply), nil
+	}
+}
+
+// Token handles a request to the token endpoint, exchanging an authorization
+// code for an access token and ID token.  The client credentials may come
+// from either HTTP basic auth or the form.
+func Token(clientID, clientSecret string, form url.Values) (*TokenReply, error) {
+
+	if form.Get("grant_type") != "authorization_code" {
+		return nil, ErrOAuthUnsupportedGrant
+	}
+
+	secretHash, _, err := getClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(secretHash), []byte(hashSecret(clientSecret))) != 1 {
+		return nil, ErrOAuthInvalidClient
+	}
+
+	var (
+		codeClient, redirectURI, scope, nonce, challenge string
+		mid, authTime, expiry                            int64
+		isMfa                                            bool
+	)
+
+	// Codes may only be used once, so delete it once it checks out.  Until
+	// then it's left alone, so that another client that has somehow got hold
+	// of the code can't use it up before the real one does.
+	code := form.Get("code")
+	err = inTx(func(t *sql.Tx) error {
+		if err := t.QueryRow(
+			"SELECT client_id, member_id, is_mfa, auth_time, redirect_uri, scope, nonce, challenge, expires_at FROM "+oidcCodeTable+" WHERE code=? FOR UPDATE",
+			code).Scan(&codeClient, &mid, &isMfa, &authTime, &redirectURI, &scope, &nonce, &challenge, &expiry); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrOAuthInvalidGrant
+			}
+			return err
+		}
+		if codeClient != clientID || redirectURI != form.Get("redirect_uri") || expiry < timestamp() {
+			return ErrOAuthInvalidGrant
+		}
+		if challenge != "" && pkceChallenge(form.Get("code_verifier")) != challenge {
+			return ErrOAuthInvalidGrant
+		}
+		_, err := t.Exec("DELETE FROM "+oidcCodeTable+" WHERE code=?", code)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := getMember(mid)
+	if err == ErrDisabledAccount {
+		return nil, ErrOAuthInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.mfa = isMfa
+
+	now := timestamp()
+	claims := memberClaims(m, scope)
+	claims["iss"] = Issuer
+	claims["aud"] = clientID
+	claims["iat"] = now
+	claims["exp"] = now + IDTokenLifetime
+	claims["auth_time"] = authTime
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	idToken, err := signJWT(signingKey, signingKid, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// Access tokens are stored hashed, so that a leak of the table doesn't
+	// give away working tokens.
+	accessToken := RandomToken(32)
+	if _, err := db.Exec(
+		"INSERT INTO "+oidcTokenTable+" (token_hash, client_id, member_id, is_mfa, scope, expires_at) VALUES (?,?,?,?,?,?)",
+		hashSecret(accessToken), clientID, mid, isMfa, scope, now+AccessTokenLifetime); err != nil {
+		return nil, err
+	}
+
+	return &TokenReply{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   AccessTokenLifetime,
+		IDToken:     idToken,
+		Scope:       scope,
+	}, nil
+}
+
+// UserInfo returns the claims about the member that an access token was
+// issued for, as far as the token's scope allows.
+func UserInfo(accessToken string) (map[string]interface{}, error) {
+
+	var (
+		mid, expiry int64
+		isMfa       bool
+		scope       string
+	)
+	if err := db.QueryRow(
+		"SELECT member_id, is_mfa, scope, expires_at FROM "+oidcTokenTable+" WHERE token_hash=?",
+		hashSecret(accessToken)).Scan(&mid, &isMfa, &scope, &expiry); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOAuthInvalidToken
+		}
+		return nil, err
+	}
+	if expiry < timestamp() {
+		return nil, ErrOAuthInvalidToken
+	}
+
+	m, err := getMember(mid)
+	if err == ErrDisabledAccount {
+		return nil, ErrOAuthInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.mfa = isMfa
+	return memberClaims(m, scope), nil
+}
+
+// memberClaims returns the claims that describe a member, leaving out those
+// that the client wasn't granted the scope for.
+func memberClaims(m *Member, scope string) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":   strconv.FormatInt(m.id, 10),
+		"roles": m.activeRoles(),
+	}
+	if hasWord(scope, "email") {
+		// A member's email address is always one they've proved they own.
+		claims["email"] = m.Email
+		claims["email_verified"] = true
+	}
+	if hasWord(scope, "profile") {
+		claims["name"] = m.FullName
+		claims["fullname"] = m.FullName
+		claims["shortname"] = m.ShortName
+	}
+	return claims
+}
+
+// Discovery returns the OpenID Connect discovery document.
+func Discovery() map[string]interface{} {
+	return map[string]interface{}{
+		"issuer":                                Issuer,
+		"authorization_endpoint":                Issuer + "/authorize",
+		"token_endpoint":                        Issuer + "/token",
+		"userinfo_endpoint":                     Issuer + "/userinfo",
+		"jwks_uri":                              Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified", "name", "fullname", "shortname", "roles"},
+	}
+}
+
+// JWKS returns the key set that relying parties use to verify our ID tokens.
+func JWKS() map[string]interface{} {
+	pub := signingKey.PublicKey
+	return map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": signingKid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	}
+}
+
+// addQuery adds parameters to a URL that may already have a query.
+func addQuery(u string, q url.Values) string {
+	if strings.Contains(u, "?") {
+		return u + "&" + q.Encode()
+	}
+	return u + "?" + q.Encode()
+}
+
+// hasWord returns true if the space-separated list s contains w.
+func hasWord(s, w string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == w {
+			return true
+		}
+	}
+	return false
+}
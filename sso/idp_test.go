@@ -0,0 +1,191 @@
+package sso
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testClient registers a relying party that may be sent back to redirectURI,
+// and deletes it when the test is done.
+func testClient(t *testing.T, redirectURI string) (string, string) {
+	t.Helper()
+	id, secret, err := RegisterClient("test", []string{redirectURI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM "+oidcClientTable+" WHERE client_id=?", id) })
+	return id, secret
+}
+
+// authorize has m authorize a request from a client, and returns the code
+// the client is sent back with.
+func authorize(t *testing.T, m *Member, q url.Values) string {
+	t.Helper()
+	back, err := Authorize(m, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := u.Query().Get("error"); e != "" {
+		t.Fatalf("authorize: %s", e)
+	}
+	return u.Query().Get("code")
+}
+
+func TestIdPRedirectURIs(t *testing.T) {
+	testDB(t)
+
+	redirectURI := "https://app.example.com/callback"
+	id, _ := testClient(t, redirectURI)
+
+	if err := CheckAuthorize(url.Values{"client_id": {id}, "redirect_uri": {redirectURI}}); err != nil {
+		t.Errorf("registered URI: %v", err)
+	}
+	for _, uri := range []string{
+		"",
+		"https://evil.example.com/callback",
+		"https://app.example.com/callback/../evil",
+		"https://app.example.com/callback?x=1",
+		"https://app.example.com/callback\nhttps://evil.example.com",
+	} {
+		if err := CheckAuthorize(url.Values{"client_id": {id}, "redirect_uri": {uri}}); err == nil {
+			t.Errorf("%q: no error", uri)
+		}
+	}
+	if err := CheckAuthorize(url.Values{"client_id": {"nobody"}, "redirect_uri": {redirectURI}}); err != ErrOAuthInvalidClient {
+		t.Errorf("unknown client: got %v", err)
+	}
+}
+
+func TestIdPCodeExchange(t *testing.T) {
+	testDB(t)
+	SetSigningKey(testKey(t, "idp"))
+	Issuer = "https://sso.example.com/oidc"
+
+	m := testMember(t)
+	redirectURI := "https://app.example.com/callback"
+	id, secret := testClient(t, redirectURI)
+	q := url.Values{
+		"client_id":     {id},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid email"},
+		"nonce":         {"n-0S6_WzA2Mj"},
+	}
+	form := func(code string) url.Values {
+		return url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}}
+	}
+
+	code := authorize(t, m, q)
+	if _, err := Token(id, "wrong", form(code)); err != ErrOAuthInvalidClient {
+		t.Errorf("wrong secret: got %v", err)
+	}
+	wrongURI := form(code)
+	wrongURI.Set("redirect_uri", "https://app.example.com/other")
+	if _, err := Token(id, secret, wrongURI); err != ErrOAuthInvalidGrant {
+		t.Errorf("wrong redirect_uri: got %v", err)
+	}
+
+	// The failures above didn't use up the code.
+	reply, err := Token(id, secret, form(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ID token is signed with our key, and says who the member is, how
+	// long ago they signed in, and nothing they didn't agree to share.
+	keys := NewJWKSCache(func() ([]byte, error) { return json.Marshal(JWKS()) })
+	var claims map[string]interface{}
+	if err := verifyJWT(reply.IDToken, keys, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["aud"] != id || claims["iss"] != Issuer || claims["nonce"] != "n-0S6_WzA2Mj" ||
+		claims["email"] != m.Email || claims["email_verified"] != true ||
+		claims["auth_time"] != float64(m.signinAt) {
+		t.Errorf("claims: %v", claims)
+	}
+	if _, ok := claims["name"]; ok {
+		t.Errorf("profile claims without the profile scope: %v", claims)
+	}
+
+	// Codes only work once.
+	if _, err := Token(id, secret, form(code)); err != ErrOAuthInvalidGrant {
+		t.Errorf("code reused: got %v", err)
+	}
+
+	info, err := UserInfo(reply.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["email"] != m.Email || info["sub"] != claims["sub"] {
+		t.Errorf("userinfo: %v", info)
+	}
+
+	// Without the email scope, the email address stays private.
+	q.Set("scope", "openid profile")
+	reply, err = Token(id, secret, form(authorize(t, m, q)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = UserInfo(reply.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info["email"]; ok || info["fullname"] != m.FullName {
+		t.Errorf("userinfo without email scope: %v", info)
+	}
+
+	if _, err := UserInfo("bogus"); err != ErrOAuthInvalidToken {
+		t.Errorf("bogus token: got %v", err)
+	}
+}
+
+func TestIdPPKCE(t *testing.T) {
+	testDB(t)
+	SetSigningKey(testKey(t, "idp"))
+
+	m := testMember(t)
+	redirectURI := "https://app.example.com/callback"
+	id, secret := testClient(t, redirectURI)
+	verifier := RandomToken(43)
+	q := url.Values{
+		"client_id":             {id},
+		"redirect_uri":          {redirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	form := func(code, verifier string) url.Values {
+		f := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}}
+		if verifier != "" {
+			f.Set("code_verifier", verifier)
+		}
+		return f
+	}
+
+	code := authorize(t, m, q)
+	for name, v := range map[string]string{"no verifier": "", "wrong verifier": RandomToken(43)} {
+		if _, err := Token(id, secret, form(code, v)); err != ErrOAuthInvalidGrant {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	if _, err := Token(id, secret, form(code, verifier)); err != nil {
+		t.Errorf("right verifier: %v", err)
+	}
+
+	// Only S256 challenges are accepted.
+	q.Set("code_challenge_method", "plain")
+	back, err := Authorize(m, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(back, "error=invalid_request") {
+		t.Errorf("plain challenge: sent back to %s", back)
+	}
+}
@@ -0,0 +1,171 @@
+package sso
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// janitorBatch is the most rows the janitor deletes per statement, so as not
+// to hold locks for long.
+const janitorBatch = 1000
+
+// janitorLock is the name of the MySQL lock that keeps janitors on different
+// servers from working at the same time.
+const janitorLock = "fsso_janitor"
+
+// janitorStats counts the janitor's runs and errors and the rows it has
+// deleted from each table, since the server started.
+var janitorStats = struct {
+	sync.Mutex
+	counts map[string]int64
+}{counts: map[string]int64{}}
+
+// countJanitor adds n to one of the janitor's counts.
+func countJanitor(key string, n int64) {
+	janitorStats.Lock()
+	janitorStats.counts[key] += n
+	janitorStats.Unlock()
+}
+
+// JanitorStats returns a copy of the janitor's counts: "runs", "errors", and
+// the number of rows deleted from each table.
+func JanitorStats() map[string]int64 {
+	janitorStats.Lock()
+	defer janitorStats.Unlock()
+	stats := make(map[string]int64, len(janitorStats.counts))
+	for k, v := range janitorStats.counts {
+		stats[k] = v
+	}
+	return stats
+}
+
+// Type janitorJob is one kind of row that the janitor deletes.
+type janitorJob struct {
+	table string
+	where string
+	args  []interface{}
+}
+
+// RunJanitor deletes expired sessions, tokens and challenges, and members
+// whose deletion grace period is up, every interval until ctx is cancelled.
+// It may run on several servers at once; only one of them does the work at a
+// time.
+func RunJanitor(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := cleanUp(ctx); err != nil && ctx.Err() == nil {
+			countJanitor("errors", 1)
+			log.Println(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanUp makes one pass over all the jobs, unless another server's janitor
+// is busy.
+func cleanUp(ctx context.Context) error {
+
+	// The lock belongs to a connection, so hold on to one while we work.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var got int
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", janitorLock).Scan(&got); err != nil {
+		return err
+	}
+	if got != 1 {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", janitorLock)
+
+	countJanitor("runs", 1)
+	for _, job := range janitorJobs(timestamp()) {
+		if err := job.run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// janitorJobs lists what's due for deletion at time now.
+func janitorJobs(now int64) []janitorJob {
+
+	jobs := []janitorJob{
+		{refreshTable, "expires_at<?", []interface{}{now}},
+		{refreshUsedTable, "expires_at<?", []interface{}{now}},
+		{emailVerifyTable, "expires_at<?", []interface{}{now}},
+		{passwordResetTable, "expires_at<?", []interface{}{now}},
+		{oauthStateTable, "expires_at<?", []interface{}{now}},
+		{nonceTable, "expires_at<?", []interface{}{now}},
+		{oidcCodeTable, "expires_at<?", []interface{}{now}},
+		{oidcTokenTable, "expires_at<?", []interface{}{now}},
+		{mfaChallengeTable, "expires_at<?", []interface{}{now}},
+		{webauthnChallengeTable, "expires_at<?", []interface{}{now}},
+		{memberTable, "delete_at<>0 AND delete_at<=?", []interface{}{now}},
+	}
+	for _, isSession := range []bool{true, false} {
+		t := timeoutsFor(isSession, 0)
+		if t.Idle > 0 {
+			jobs = append(jobs, janitorJob{activeTable, "is_session=? AND active_at<?", []interface{}{isSession, now - t.Idle}})
+		}
+		if t.Lifetime > 0 {
+			jobs = append(jobs, janitorJob{activeTable, "is_session=? AND created_at<?", []interface{}{isSession, now - t.Lifetime}})
+		}
+	}
+	if AdminRoles != 0 && AdminIdleTimeout > 0 {
+		jobs = append(jobs, janitorJob{activeTable,
+			"active_at<? AND member_id IN (SELECT id FROM " + memberTable + " WHERE roles&?<>0)",
+			[]interface{}{now - AdminIdleTimeout, AdminRoles}})
+	}
+	if Lockout != nil {
+		jobs = append(jobs, janitorJob{failureTable, "failed_at<? AND locked_until<?", []interface{}{now - Lockout.Window, now}})
+	}
+	return jobs
+}
+
+// run deletes the job's rows a batch at a time.
+func (j janitorJob) run(ctx context.Context) error {
+
+	args := append(j.args, janitorBatch)
+	for {
+		res, err := db.ExecContext(ctx,
+			"DELETE FROM "+j.table+" WHERE "+j.where+" LIMIT ?",
+			args...)
+		if isDeadlock(err) {
+			// Someone else is using those rows; we'll get them next time.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		countJanitor(j.table, n)
+		if n < janitorBatch {
+			return nil
+		}
+	}
+}
+
+// isDeadlock tests err to see if a db error means that the statement lost a
+// deadlock or timed out waiting for a lock.
+func isDeadlock(err error) bool {
+	if err0, ok := err.(*mysql.MySQLError); ok {
+		// 1205 is lock wait timeout, 1213 is deadlock
+		return err0.Number == 1205 || err0.Number == 1213
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package sso
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultClient is used for requests to providers when no client is given.
+// Unlike http.DefaultClient, it gives up on a provider that doesn't answer,
+// so that one can't hold up every signin.
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// Type KeySource supplies the public keys used to verify signed tokens.
+type KeySource interface {
+	// PublicKey returns the key with the given key id, or nil if there is no
+	// such key.
+	PublicKey(kid string) (*rsa.PublicKey, error)
+}
+
+// Type JWKSFetcher retrieves a raw JSON Web Key Set document.
+type JWKSFetcher func() ([]byte, error)
+
+// FileJWKS returns a JWKSFetcher that reads a key set from a local file.
+func FileJWKS(path string) JWKSFetcher {
+	return func() ([]byte, error) {
+		return ioutil.ReadFile(path)
+	}
+}
+
+// URLJWKS returns a JWKSFetcher that downloads a key set using client.
+// If client is nil, a client with a 10 second timeout is used.
+func URLJWKS(client *http.Client, url string) JWKSFetcher {
+	if client == nil {
+		client = defaultClient
+	}
+	return func() ([]byte, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+}
+
+// Type JWKSCache is a KeySource that caches the keys returned by a
+// JWKSFetcher.
+//
+// Keys are fetched again once MaxAge seconds have passed, or when a token
+// names a key we haven't seen, which is how providers rotate their keys.
+// To avoid hammering the provider with bogus key ids, an unknown key id
+// triggers at most one fetch per MinRefetch seconds.  Failed fetches count
+// too, so a provider that's down isn't asked again on every request.
+//
+// Only one fetch runs at a time, and the cache isn't locked while it does.
+// Meanwhile, other requests make do with the keys we already have, or wait
+// for the fetch if there are none.
+type JWKSCache struct {
+	Fetch      JWKSFetcher
+	MaxAge     int64
+	MinRefetch int64
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt int64         // time of the last fetch, whether or not it worked
+	fetchErr  error         // why the last fetch failed, if it did
+	fetching  chan struct{} // closed when the fetch under way is done
+}
+
+// NewJWKSCache creates a JWKSCache with the default refresh intervals.
+func NewJWKSCache(fetch JWKSFetcher) *JWKSCache {
+	return &JWKSCache{Fetch: fetch, MaxAge: 3600, MinRefetch: 60}
+}
+
+// PublicKey implements KeySource.
+func (c *JWKSCache) PublicKey(kid string) (*rsa.PublicKey, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// With no keys at all, wait for any fetch under way.
+	for c.fetching != nil && c.keys == nil {
+		done := c.fetching
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+	}
+
+	now := timestamp()
+	_, known := c.keys[kid]
+	since := now - c.fetchedAt
+	stale := since >= c.MaxAge || !known && since >= c.MinRefetch
+
+	if stale && c.fetching == nil {
+		done := make(chan struct{})
+		c.fetching, c.fetchedAt = done, now
+		c.mu.Unlock()
+		keys, err := c.load()
+		c.mu.Lock()
+		c.fetching, c.fetchErr = nil, err
+		close(done)
+		// Keep using the keys we have, if any.
+		if err == nil {
+			c.keys = keys
+		}
+	}
+
+	if c.keys == nil {
+		return nil, c.fetchErr
+	}
+	return c.keys[kid], nil
+}
+
+// load fetches and parses the key set.
+func (c *JWKSCache) load() (map[string]*rsa.PublicKey, error) {
+	b, err := c.Fetch()
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(b)
+}
+
+// Type jwk is a single JSON Web Key.  Only RSA keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// parseJWKS decodes a JSON Web Key Set into RSA public keys indexed by key id.
+// Keys that aren't RSA signing keys are ignored.
+func parseJWKS(b []byte) (map[string]*rsa.PublicKey, error) {
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("jwks: RSA exponent too large")
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+	}
+	return keys, nil
+}
@@ -0,0 +1,223 @@
+package sso
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+)
+
+// testKeys holds RSA keys made for the tests, by name.  Making them is slow,
+// so each is made once.
+var testKeys struct {
+	sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+// testKey returns the test key with the given name, making it if need be.
+func testKey(t *testing.T, name string) *rsa.PrivateKey {
+	t.Helper()
+	testKeys.Lock()
+	defer testKeys.Unlock()
+	if k, ok := testKeys.keys[name]; ok {
+		return k
+	}
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testKeys.keys == nil {
+		testKeys.keys = make(map[string]*rsa.PrivateKey)
+	}
+	testKeys.keys[name] = k
+	return k
+}
+
+// jwksFor returns a JSON Web Key Set holding the public halves of keys, by
+// key id.
+func jwksFor(keys map[string]*rsa.PrivateKey) []byte {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	for kid, k := range keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		})
+	}
+	b, _ := json.Marshal(set)
+	return b
+}
+
+// Type fakeJWKS is a JWKSFetcher for a key set that tests can change, which
+// counts how often it's fetched.
+type fakeJWKS struct {
+	doc     []byte
+	err     error
+	fetches int
+}
+
+func (f *fakeJWKS) fetch() ([]byte, error) {
+	f.fetches++
+	return f.doc, f.err
+}
+
+func TestParseJWKS(t *testing.T) {
+
+	k := testKey(t, "a")
+	keys, err := parseJWKS(jwksFor(map[string]*rsa.PrivateKey{"a": k}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub := keys["a"]; pub == nil || pub.N.Cmp(k.N) != 0 || pub.E != k.E {
+		t.Errorf("got %v", keys)
+	}
+
+	// Keys that aren't for RSA signatures are skipped.
+	keys, err = parseJWKS([]byte(`{"keys":[{"kty":"EC","kid":"ec"},{"kty":"RSA","kid":"enc","use":"enc","n":"AQ","e":"AQAB"}]}`))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("got %v, %v", keys, err)
+	}
+
+	for _, doc := range []string{
+		`not json`,
+		`{"keys":[{"kty":"RSA","kid":"a","n":"!!","e":"AQAB"}]}`,
+		`{"keys":[{"kty":"RSA","kid":"a","n":"AQ","e":"!!"}]}`,
+		`{"keys":[{"kty":"RSA","kid":"a","n":"AQ","e":"AQAAAAAAAAAAAAAA"}]}`,
+	} {
+		if _, err := parseJWKS([]byte(doc)); err == nil {
+			t.Errorf("%s: no error", doc)
+		}
+	}
+}
+
+func TestJWKSCacheRotation(t *testing.T) {
+
+	a, b := testKey(t, "a"), testKey(t, "b")
+	f := &fakeJWKS{doc: jwksFor(map[string]*rsa.PrivateKey{"a": a})}
+	c := &JWKSCache{Fetch: f.fetch, MaxAge: 3600, MinRefetch: 0}
+
+	if k, err := c.PublicKey("a"); err != nil || k == nil || k.N.Cmp(a.N) != 0 {
+		t.Fatalf("a: got %v, %v", k, err)
+	}
+	if k, _ := c.PublicKey("a"); k == nil || f.fetches != 1 {
+		t.Errorf("a again: %d fetches", f.fetches)
+	}
+
+	// The provider starts signing with a new key; the first token naming it
+	// makes us fetch the key set again.
+	f.doc = jwksFor(map[string]*rsa.PrivateKey{"b": b})
+	if k, err := c.PublicKey("b"); err != nil || k == nil || k.N.Cmp(b.N) != 0 {
+		t.Fatalf("b: got %v, %v", k, err)
+	}
+	if f.fetches != 2 {
+		t.Errorf("b: %d fetches", f.fetches)
+	}
+
+	// The old key is gone.
+	if k, err := c.PublicKey("a"); err != nil || k != nil {
+		t.Errorf("a after rotation: got %v, %v", k, err)
+	}
+}
+
+func TestJWKSCacheMinRefetch(t *testing.T) {
+
+	f := &fakeJWKS{doc: jwksFor(map[string]*rsa.PrivateKey{"a": testKey(t, "a")})}
+	c := NewJWKSCache(f.fetch)
+
+	if k, _ := c.PublicKey("a"); k == nil {
+		t.Fatal("a: no key")
+	}
+	// Bogus key ids don't make us fetch the key set over and over.
+	for i := 0; i < 3; i++ {
+		if k, err := c.PublicKey("bogus"); err != nil || k != nil {
+			t.Errorf("bogus: got %v, %v", k, err)
+		}
+	}
+	if f.fetches != 1 {
+		t.Errorf("%d fetches", f.fetches)
+	}
+}
+
+func TestJWKSCacheFetchError(t *testing.T) {
+
+	f := &fakeJWKS{err: errors.New("down")}
+	c := &JWKSCache{Fetch: f.fetch, MaxAge: 0, MinRefetch: 0}
+
+	if _, err := c.PublicKey("a"); err == nil {
+		t.Error("no keys yet: no error")
+	}
+
+	// Once we have keys, we keep using them while the provider is down.
+	f.doc, f.err = jwksFor(map[string]*rsa.PrivateKey{"a": testKey(t, "a")}), nil
+	if k, _ := c.PublicKey("a"); k == nil {
+		t.Fatal("a: no key")
+	}
+	f.err = errors.New("down")
+	if k, err := c.PublicKey("a"); err != nil || k == nil {
+		t.Errorf("a while down: got %v, %v", k, err)
+	}
+	if f.fetches != 3 {
+		t.Errorf("%d fetches", f.fetches)
+	}
+}
+
+func TestJWKSCacheFailureBackoff(t *testing.T) {
+
+	f := &fakeJWKS{err: errors.New("down")}
+	c := NewJWKSCache(f.fetch)
+
+	// A provider that's down isn't asked again on every request.
+	for i := 0; i < 3; i++ {
+		if _, err := c.PublicKey("a"); err == nil {
+			t.Error("no error")
+		}
+	}
+	if f.fetches != 1 {
+		t.Errorf("%d fetches", f.fetches)
+	}
+}
+
+func TestJWKSCacheFetchUnlocked(t *testing.T) {
+
+	a := testKey(t, "a")
+	doc := jwksFor(map[string]*rsa.PrivateKey{"a": a})
+	started, release := make(chan bool), make(chan bool)
+	fetches := 0
+	c := &JWKSCache{MaxAge: 0, MinRefetch: 0, Fetch: func() ([]byte, error) {
+		fetches++
+		if fetches > 1 {
+			started <- true
+			<-release
+		}
+		return doc, nil
+	}}
+
+	if k, _ := c.PublicKey("a"); k == nil {
+		t.Fatal("a: no key")
+	}
+
+	// While a slow fetch is under way, other requests use the keys we have
+	// rather than waiting or fetching again.
+	done := make(chan bool)
+	go func() {
+		c.PublicKey("a")
+		done <- true
+	}()
+	<-started
+	if k, err := c.PublicKey("a"); err != nil || k == nil {
+		t.Errorf("during fetch: got %v, %v", k, err)
+	}
+	close(release)
+	<-done
+	if fetches != 2 {
+		t.Errorf("%d fetches", fetches)
+	}
+}
@@ -0,0 +1,147 @@
+package sso
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// clockSkew is the number of seconds of leeway allowed when checking token
+// expiry times issued by other servers.
+const clockSkew = 60
+
+// Type idClaims holds the claims we use from an OpenID Connect ID token.
+type idClaims struct {
+	Iss           string   `json:"iss"`
+	Sub           string   `json:"sub"`
+	Aud           audience `json:"aud"`
+	Azp           string   `json:"azp"`
+	Exp           int64    `json:"exp"`
+	Iat           int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified flexBool `json:"email_verified"`
+	Name          string   `json:"name"`
+	GivenName     string   `json:"given_name"`
+}
+
+// Type audience is the aud claim, which may be either a string or an array
+// of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// Contains returns true if the audience includes id.
+func (a audience) Contains(id string) bool {
+	for _, s := range a {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Type flexBool is a boolean claim that some providers send as a string.
+type flexBool bool
+
+func (f *flexBool) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*f = flexBool(v)
+	case string:
+		*f = flexBool(v == "true")
+	}
+	return nil
+}
+
+// Type jwtHeader is the JOSE header of a signed JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// verifyJWT checks the RS256 signature on a compact-serialized JWT against
+// the key named in its header, and decodes the claims into v.  Returns
+// ErrInvalidItoken if the token is malformed or the signature is bad.
+func verifyJWT(token string, keys KeySource, v interface{}) error {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidItoken
+	}
+
+	var hdr jwtHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return ErrInvalidItoken
+	}
+	if hdr.Alg != "RS256" {
+		return ErrInvalidItoken
+	}
+
+	key, err := keys.PublicKey(hdr.Kid)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return ErrInvalidItoken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidItoken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return ErrInvalidItoken
+	}
+
+	if err := decodeSegment(parts[1], v); err != nil {
+		return ErrInvalidItoken
+	}
+	return nil
+}
+
+// signJWT creates a compact-serialized RS256 JWT with the given claims.
+func signJWT(key *rsa.PrivateKey, kid string, claims interface{}) (string, error) {
+
+	hdr, err := json.Marshal(jwtHeader{Alg: "RS256", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// decodeSegment base64url-decodes and json-decodes one part of a JWT.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
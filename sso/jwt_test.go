@@ -0,0 +1,227 @@
+package sso
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testClientID = "client.example.com"
+
+// googleClaims returns the claims of a good Google ID token for testClientID,
+// for tests to spoil.
+func googleClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"sub":            "1234567890",
+		"aud":            testClientID,
+		"exp":            timestamp() + 3600,
+		"iat":            timestamp(),
+		"nonce":          "n0nce",
+		"email":          "me@example.com",
+		"email_verified": true,
+		"name":           "Jo Bloggs",
+		"given_name":     "Jo",
+	}
+}
+
+// mustSign signs claims with key under kid.
+func mustSign(t *testing.T, key *rsa.PrivateKey, kid string, claims interface{}) string {
+	t.Helper()
+	token, err := signJWT(key, kid, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// rawJWT puts together a token from a header, claims and signature, none of
+// which need make sense.
+func rawJWT(hdr, claims interface{}, sig string) string {
+	h, _ := json.Marshal(hdr)
+	c, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c) + "." + sig
+}
+
+func TestGoogleVerify(t *testing.T) {
+
+	a := testKey(t, "a")
+	f := &fakeJWKS{doc: jwksFor(map[string]*rsa.PrivateKey{"a": a})}
+	g := &GoogleProvider{ClientID: testClientID, Keys: &JWKSCache{Fetch: f.fetch, MaxAge: 3600}}
+
+	id, err := g.Verify(mustSign(t, a, "a", googleClaims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Uid: "1234567890", Email: "me@example.com", FullName: "Jo Bloggs", ShortName: "Jo", Nonce: "n0nce"}
+	if *id != want {
+		t.Errorf("got %+v, want %+v", *id, want)
+	}
+
+	// Each of these spoils a good token.
+	spoil := map[string]func(c map[string]interface{}){
+		"wrong iss":            func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong aud":            func(c map[string]interface{}) { c["aud"] = "someone.else" },
+		"expired":              func(c map[string]interface{}) { c["exp"] = timestamp() - clockSkew - 1 },
+		"email not verified":   func(c map[string]interface{}) { c["email_verified"] = false },
+		"email_verified false": func(c map[string]interface{}) { c["email_verified"] = "false" },
+		"no email_verified":    func(c map[string]interface{}) { delete(c, "email_verified") },
+		"no email":             func(c map[string]interface{}) { delete(c, "email") },
+		"no sub":               func(c map[string]interface{}) { delete(c, "sub") },
+	}
+	for name, f := range spoil {
+		c := googleClaims()
+		f(c)
+		if _, err := g.Verify(mustSign(t, a, "a", c)); err != ErrInvalidItoken {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	// These are fine.
+	allow := map[string]func(c map[string]interface{}){
+		"iss without https":     func(c map[string]interface{}) { c["iss"] = "accounts.google.com" },
+		"aud array":             func(c map[string]interface{}) { c["aud"] = []string{"other", testClientID} },
+		"within clock skew":     func(c map[string]interface{}) { c["exp"] = timestamp() - clockSkew + 5 },
+		"email_verified string": func(c map[string]interface{}) { c["email_verified"] = "true" },
+	}
+	for name, f := range allow {
+		c := googleClaims()
+		f(c)
+		if _, err := g.Verify(mustSign(t, a, "a", c)); err != nil {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestVerifyJWTSignature(t *testing.T) {
+
+	a, b := testKey(t, "a"), testKey(t, "b")
+	f := &fakeJWKS{doc: jwksFor(map[string]*rsa.PrivateKey{"a": a})}
+	keys := &JWKSCache{Fetch: f.fetch, MaxAge: 3600, MinRefetch: 3600}
+
+	good := mustSign(t, a, "a", googleClaims())
+	parts := strings.Split(good, ".")
+
+	evil := googleClaims()
+	evil["sub"] = "someone else"
+	evilBody := strings.Split(mustSign(t, a, "a", evil), ".")[1]
+
+	tests := map[string]string{
+		"signed by another key": mustSign(t, b, "a", googleClaims()),
+		"unknown kid":           mustSign(t, b, "b", googleClaims()),
+		"claims changed":        parts[0] + "." + evilBody + "." + parts[2],
+		"no signature":          parts[0] + "." + parts[1] + ".",
+		"signature not base64":  parts[0] + "." + parts[1] + ".!!",
+		"alg none":              rawJWT(jwtHeader{Alg: "none", Kid: "a"}, googleClaims(), ""),
+		"alg HS256":             rawJWT(jwtHeader{Alg: "HS256", Kid: "a"}, googleClaims(), parts[2]),
+		"two parts":             parts[0] + "." + parts[1],
+		"four parts":            good + ".x",
+		"header not base64":     "!!." + parts[1] + "." + parts[2],
+		"header not json":       base64.RawURLEncoding.EncodeToString([]byte("{")) + "." + parts[1] + "." + parts[2],
+		"empty":                 "",
+	}
+	for name, token := range tests {
+		var c idClaims
+		if err := verifyJWT(token, keys, &c); err != ErrInvalidItoken {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	var c idClaims
+	if err := verifyJWT(good, keys, &c); err != nil || c.Sub != "1234567890" {
+		t.Errorf("good: got %+v, %v", c, err)
+	}
+}
+
+func TestGoogleVerifyKeyRotation(t *testing.T) {
+
+	a, b := testKey(t, "a"), testKey(t, "b")
+	f := &fakeJWKS{doc: jwksFor(map[string]*rsa.PrivateKey{"a": a})}
+	g := &GoogleProvider{ClientID: testClientID, Keys: &JWKSCache{Fetch: f.fetch, MaxAge: 3600}}
+
+	if _, err := g.Verify(mustSign(t, a, "a", googleClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// Google publishes both keys for a while, then drops the old one.
+	f.doc = jwksFor(map[string]*rsa.PrivateKey{"a": a, "b": b})
+	if _, err := g.Verify(mustSign(t, b, "b", googleClaims())); err != nil {
+		t.Errorf("new key: %v", err)
+	}
+	if _, err := g.Verify(mustSign(t, a, "a", googleClaims())); err != nil {
+		t.Errorf("old key while both published: %v", err)
+	}
+
+	f.doc = jwksFor(map[string]*rsa.PrivateKey{"b": b})
+	g.Keys.(*JWKSCache).MaxAge = 0
+	if _, err := g.Verify(mustSign(t, a, "a", googleClaims())); err != ErrInvalidItoken {
+		t.Errorf("old key after it's dropped: got %v", err)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+
+	a := testKey(t, "a")
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcConfig{Issuer: issuer, JwksURI: issuer + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwksFor(map[string]*rsa.PrivateKey{"a": a}))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	issuer = srv.URL
+
+	o := NewOIDCProvider("test", issuer, testClientID)
+	o.Client = srv.Client()
+
+	claims := func() map[string]interface{} {
+		c := googleClaims()
+		c["iss"] = issuer
+		return c
+	}
+
+	id, err := o.Verify(mustSign(t, a, "a", claims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Uid != "1234567890" || id.Email != "me@example.com" || id.Nonce != "n0nce" {
+		t.Errorf("got %+v", id)
+	}
+
+	// An address the provider doesn't vouch for isn't passed on.
+	c := claims()
+	c["email_verified"] = false
+	if id, err := o.Verify(mustSign(t, a, "a", c)); err != nil || id.Email != "" {
+		t.Errorf("email not verified: got %+v, %v", id, err)
+	}
+
+	spoil := map[string]func(c map[string]interface{}){
+		"wrong iss":       func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong aud":       func(c map[string]interface{}) { c["aud"] = "someone.else" },
+		"expired":         func(c map[string]interface{}) { c["exp"] = timestamp() - clockSkew - 1 },
+		"no sub":          func(c map[string]interface{}) { delete(c, "sub") },
+		"shared, no azp":  func(c map[string]interface{}) { c["aud"] = []string{testClientID, "other"} },
+		"issued to other": func(c map[string]interface{}) { c["azp"] = "other" },
+	}
+	for name, f := range spoil {
+		c := claims()
+		f(c)
+		if _, err := o.Verify(mustSign(t, a, "a", c)); err != ErrInvalidItoken {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	c = claims()
+	c["aud"] = []string{testClientID, "other"}
+	c["azp"] = testClientID
+	if _, err := o.Verify(mustSign(t, a, "a", c)); err != nil {
+		t.Errorf("shared, issued to us: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package sso
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Type LockoutError is returned when there have been too many failed attempts
+// to sign in to an account or from an address.  RetryAfter is the number of
+// seconds until the next attempt will be allowed.
+type LockoutError struct {
+	RetryAfter int64
+}
+
+func (e *LockoutError) Error() string {
+	return ErrLockedOut.Message
+}
+
+// Type AttemptCounter keeps track of failed signin attempts, by key.  Use a
+// counter that keeps its state in the database, such as MySQLCounter, to
+// share it between several servers.
+type AttemptCounter interface {
+
+	// Fail records a failed attempt for key and returns the number of
+	// failures so far, including this one.  Failures are forgotten once
+	// window seconds go by without one.
+	Fail(key string, window int64) (int, error)
+
+	// Lock locks key out until the given time.
+	Lock(key string, until int64) error
+
+	// LockedUntil returns the time that key is locked out until, which is in
+	// the past if it isn't locked out.
+	LockedUntil(key string) (int64, error)
+
+	// Reset forgets all failures for key.
+	Reset(key string) error
+}
+
+// Type LockoutPolicy says how failed signin attempts are throttled.  Once
+// an account or client IP has used up its free attempts, each further failure
+// locks it out for twice as long as the last, from BaseDelay up to MaxDelay
+// seconds.
+type LockoutPolicy struct {
+	Counter         AttemptCounter
+	AccountAttempts int   // free attempts per account
+	IPAttempts      int   // free attempts per client IP
+	BaseDelay       int64 // seconds
+	MaxDelay        int64 // seconds
+	Window          int64 // seconds without a failure before failures are forgotten
+}
+
+// Lockout is the policy applied by AuthEmail, and to passwords and
+// two-factor codes entered by members who are already part way signed in.
+// Set it to nil to turn off throttling.
+var Lockout = &LockoutPolicy{
+	Counter:         NewMemoryCounter(),
+	AccountAttempts: 5,
+	IPAttempts:      50,
+	BaseDelay:       30,
+	MaxDelay:        3600,
+	Window:          86400,
+}
+
+// accountKey and ipKey are the counter keys for an email address and a
+// client IP.
+func accountKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// memberKey is the counter key for a member's second factor.
+func memberKey(mid int64) string {
+	return "member:" + strconv.FormatInt(mid, 10)
+}
+
+// ClientIP returns the IP address that a request came from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// check returns a *LockoutError if any of the keys is locked out.
+func (l *LockoutPolicy) check(keys ...string) error {
+	now := timestamp()
+	var wait int64
+	for _, k := range keys {
+		until, err := l.Counter.LockedUntil(k)
+		if err != nil {
+			return err
+		}
+		if until-now > wait {
+			wait = until - now
+		}
+	}
+	if wait > 0 {
+		return &LockoutError{wait}
+	}
+	return nil
+}
+
+// fail records a failed attempt against an account and a client IP, and
+// locks out whichever of them has run out of free attempts.
+func (l *LockoutPolicy) fail(email, ip string) {
+	l.failKey(accountKey(email), l.AccountAttempts)
+	l.failKey(ipKey(ip), l.IPAttempts)
+}
+
+// failKey records a failed attempt against one key, which gets free attempts
+// before it's locked out.  Errors are logged rather than returned, since the
+// caller is already failing.
+func (l *LockoutPolicy) failKey(key string, free int) {
+	n, err := l.Counter.Fail(key, l.Window)
+	if err == nil && n > free {
+		err = l.Counter.Lock(key, timestamp()+l.delay(n-free))
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// delay returns how long to lock out for after the nth failure beyond the
+// free attempts.
+func (l *LockoutPolicy) delay(n int) int64 {
+	d := l.BaseDelay
+	for i := 1; i < n && d < l.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > l.MaxDelay {
+		d = l.MaxDelay
+	}
+	return d
+}
+
+// succeed clears the failures of an account after a successful signin.  The
+// client IP keeps its failures, so that an attacker can't clear them by
+// signing in to an account of their own.
+func (l *LockoutPolicy) succeed(email string) {
+	l.reset(accountKey(email))
+}
+
+// reset clears the failures of one key.
+func (l *LockoutPolicy) reset(key string) {
+	if err := l.Counter.Reset(key); err != nil {
+		log.Println(err)
+	}
+}
+
+// Type MemoryCounter is an AttemptCounter for a single server.
+type MemoryCounter struct {
+	mu      sync.Mutex
+	entries map[string]*attempts
+	ops     int
+}
+
+// Type attempts is the state that MemoryCounter keeps for one key.
+type attempts struct {
+	failures    int
+	lastFailure int64
+	lockedUntil int64
+	window      int64
+}
+
+// NewMemoryCounter creates an empty MemoryCounter.
+func NewMemoryCounter() *MemoryCounter {
+	return &MemoryCounter{entries: make(map[string]*attempts)}
+}
+
+// Fail implements AttemptCounter.
+func (c *MemoryCounter) Fail(key string, window int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := timestamp()
+	c.sweep(now)
+
+	a := c.entries[key]
+	if a == nil || now-a.lastFailure > window {
+		a = &attempts{}
+		c.entries[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+	a.window = window
+	return a.failures, nil
+}
+
+// Lock implements AttemptCounter.
+func (c *MemoryCounter) Lock(key string, until int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if a := c.entries[key]; a != nil {
+		a.lockedUntil = until
+	}
+	return nil
+}
+
+// LockedUntil implements AttemptCounter.
+func (c *MemoryCounter) LockedUntil(key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if a := c.entries[key]; a != nil {
+		return a.lockedUntil, nil
+	}
+	return 0, nil
+}
+
+// Reset implements AttemptCounter.
+func (c *MemoryCounter) Reset(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+// sweep occasionally drops entries that have been forgotten, so that the map
+// doesn't grow without bound.
+func (c *MemoryCounter) sweep(now int64) {
+	c.ops++
+	if c.ops < 1000 {
+		return
+	}
+	c.ops = 0
+	for k, a := range c.entries {
+		if now-a.lastFailure > a.window && a.lockedUntil < now {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// Type MySQLCounter is an AttemptCounter that keeps its state in the
+// fsso_auth_failures table, so that it's shared by every server using the
+// same database.  Keys are stored hashed, since an email address can be too
+// long for the column once it has a prefix.
+type MySQLCounter struct{}
+
+// NewMySQLCounter creates a MySQLCounter.  InitDB must be called before it's
+// used.
+func NewMySQLCounter() *MySQLCounter {
+	return &MySQLCounter{}
+}
+
+// Fail implements AttemptCounter.
+func (MySQLCounter) Fail(key string, window int64) (int, error) {
+
+	now := timestamp()
+	var failures int
+
+	err := inTx(func(t *sql.Tx) error {
+		if _, err := t.Exec(
+			"INSERT INTO "+failureTable+" (fkey, failures, failed_at, locked_until) VALUES (?,1,?,0) "+
+				"ON DUPLICATE KEY UPDATE failures=IF(failed_at<?, 1, failures+1), failed_at=VALUES(failed_at)",
+			hashSecret(key), now, now-window); err != nil {
+			return err
+		}
+		return t.QueryRow(
+			"SELECT failures FROM "+failureTable+" WHERE fkey=?",
+			hashSecret(key)).Scan(&failures)
+	})
+
+	return failures, err
+}
+
+// Lock implements AttemptCounter.
+func (MySQLCounter) Lock(key string, until int64) error {
+	_, err := db.Exec(
+		"UPDATE "+failureTable+" SET locked_until=? WHERE fkey=?",
+		until, hashSecret(key))
+	return err
+}
+
+// LockedUntil implements AttemptCounter.
+func (MySQLCounter) LockedUntil(key string) (int64, error) {
+	var until int64
+	err := db.QueryRow(
+		"SELECT locked_until FROM "+failureTable+" WHERE fkey=?",
+		hashSecret(key)).Scan(&until)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return until, err
+}
+
+// Reset implements AttemptCounter.
+func (MySQLCounter) Reset(key string) error {
+	_, err := db.Exec(
+		"DELETE FROM "+failureTable+" WHERE fkey=?",
+		hashSecret(key))
+	return err
+}
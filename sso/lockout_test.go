@@ -0,0 +1,180 @@
+package sso
+
+import (
+	"strings"
+	"testing"
+)
+
+// testLockout returns a policy with small limits and a fresh counter.
+func testLockout() *LockoutPolicy {
+	return &LockoutPolicy{
+		Counter:         NewMemoryCounter(),
+		AccountAttempts: 3,
+		IPAttempts:      5,
+		BaseDelay:       30,
+		MaxDelay:        3600,
+		Window:          86400,
+	}
+}
+
+// retryAfter returns how long the keys are locked out for, or 0 if they
+// aren't.
+func retryAfter(t *testing.T, l *LockoutPolicy, keys ...string) int64 {
+	t.Helper()
+	err := l.check(keys...)
+	if err == nil {
+		return 0
+	}
+	lerr, ok := err.(*LockoutError)
+	if !ok {
+		t.Fatal(err)
+	}
+	return lerr.RetryAfter
+}
+
+func TestLockoutDelay(t *testing.T) {
+
+	l := testLockout()
+	tests := map[int]int64{1: 30, 2: 60, 3: 120, 4: 240, 7: 1920, 8: 3600, 9: 3600, 1000: 3600}
+	for n, want := range tests {
+		if got := l.delay(n); got != want {
+			t.Errorf("delay(%d): got %d, want %d", n, got, want)
+		}
+	}
+
+	// A maximum that isn't a doubling of the base is still the most we wait.
+	l.BaseDelay, l.MaxDelay = 7, 20
+	if got := l.delay(3); got != 20 {
+		t.Errorf("capped: got %d", got)
+	}
+}
+
+func TestLockoutThresholds(t *testing.T) {
+
+	l := testLockout()
+	email, ip := "Ada@Example.com", "192.0.2.1"
+
+	// The free attempts don't lock anything out.
+	for i := 0; i < l.AccountAttempts; i++ {
+		l.fail(email, ip)
+	}
+	if wait := retryAfter(t, l, accountKey(email), ipKey(ip)); wait != 0 {
+		t.Fatalf("after free attempts: locked out for %d", wait)
+	}
+
+	// The next one does, and the one after that for twice as long.  The
+	// address is the same account whatever its case.
+	l.fail("ada@example.com", ip)
+	if wait := retryAfter(t, l, accountKey(email)); wait < l.BaseDelay-1 || wait > l.BaseDelay {
+		t.Errorf("first lockout: %d", wait)
+	}
+	l.fail(email, ip)
+	if wait := retryAfter(t, l, accountKey(email)); wait < 2*l.BaseDelay-1 || wait > 2*l.BaseDelay {
+		t.Errorf("second lockout: %d", wait)
+	}
+
+	// The IP has had five failures, all free.  One more, against a different
+	// account, locks it out too.
+	if wait := retryAfter(t, l, ipKey(ip)); wait != 0 {
+		t.Errorf("IP locked out early: %d", wait)
+	}
+	l.fail("other@example.com", ip)
+	if wait := retryAfter(t, l, ipKey(ip)); wait == 0 {
+		t.Error("IP not locked out")
+	}
+	if wait := retryAfter(t, l, accountKey("other@example.com")); wait != 0 {
+		t.Errorf("other account locked out: %d", wait)
+	}
+
+	// check reports the longest wait of all the keys.
+	if wait := retryAfter(t, l, ipKey(ip), accountKey(email)); wait < 2*l.BaseDelay-1 {
+		t.Errorf("both: %d", wait)
+	}
+}
+
+func TestLockoutSucceed(t *testing.T) {
+
+	l := testLockout()
+	email, ip := "ada@example.com", "192.0.2.1"
+	for i := 0; i <= l.IPAttempts; i++ {
+		l.fail(email, ip)
+	}
+
+	// Signing in clears the account's failures, but not the IP's, so an
+	// attacker can't reset their own count with an account of their own.
+	l.succeed(email)
+	if wait := retryAfter(t, l, accountKey(email)); wait != 0 {
+		t.Errorf("account still locked out: %d", wait)
+	}
+	if wait := retryAfter(t, l, ipKey(ip)); wait == 0 {
+		t.Error("IP no longer locked out")
+	}
+
+	// The count starts again from nothing.
+	for i := 0; i < l.AccountAttempts; i++ {
+		l.fail(email, "192.0.2.2")
+	}
+	if wait := retryAfter(t, l, accountKey(email)); wait != 0 {
+		t.Errorf("locked out within free attempts: %d", wait)
+	}
+}
+
+func TestMemoryCounter(t *testing.T) {
+
+	c := NewMemoryCounter()
+
+	for want := 1; want <= 3; want++ {
+		if n, err := c.Fail("a", 60); n != want || err != nil {
+			t.Errorf("fail %d: got %d, %v", want, n, err)
+		}
+	}
+	if n, _ := c.Fail("b", 60); n != 1 {
+		t.Errorf("b: got %d", n)
+	}
+
+	now := timestamp()
+	c.Lock("a", now+60)
+	if until, _ := c.LockedUntil("a"); until != now+60 {
+		t.Errorf("locked until %d", until)
+	}
+	// Keys with no failures can't be locked.
+	c.Lock("c", now+60)
+	if until, _ := c.LockedUntil("c"); until != 0 {
+		t.Errorf("c locked until %d", until)
+	}
+
+	c.Reset("a")
+	if until, _ := c.LockedUntil("a"); until != 0 {
+		t.Errorf("after reset: locked until %d", until)
+	}
+	if n, _ := c.Fail("a", 60); n != 1 {
+		t.Errorf("after reset: got %d", n)
+	}
+
+	// Failures from before the window are forgotten.  (A negative window
+	// puts every earlier failure outside it.)
+	if n, _ := c.Fail("b", -1); n != 1 {
+		t.Errorf("outside window: got %d", n)
+	}
+}
+
+func TestMemoryCounterSweep(t *testing.T) {
+
+	c := NewMemoryCounter()
+	c.Fail("forgotten", -1)
+	c.Fail("locked", -1)
+	c.Lock("locked", timestamp()+60)
+	c.Fail("recent", 60)
+
+	// Force a sweep on the next failure.
+	c.ops = 1000
+	c.Fail("new", 60)
+
+	var keys []string
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	if _, ok := c.entries["forgotten"]; ok || len(c.entries) != 3 {
+		t.Errorf("after sweep: %s", strings.Join(keys, ", "))
+	}
+}
@@ -0,0 +1,248 @@
+package sso
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+)
+
+// Type mailTemplate is the subject and bodies of one kind of email in one
+// language.  Subject and Text are text/template; HTML is html/template.
+type mailTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Type mailData is what the templates have to work with.
+type mailData struct {
+	Name  string // member's shortname, or "" if there isn't a member yet
+	Email string
+	Link  string
+}
+
+// defaultLanguage is used when there are no templates in the language asked
+// for.
+const defaultLanguage = "en"
+
+// mailTemplates holds every kind of email we send, by language and then by
+// name.
+var mailTemplates = map[string]map[string]mailTemplate{
+	"en": {
+		"verify": {
+			Subject: "Confirm your email address",
+			Text: `Hello,
+
+Please confirm your email address ({{.Email}}) by following this link:
+
+{{.Link}}
+
+If you didn't ask to sign up, you can ignore this email.
+`,
+			HTML: `<p>Hello,</p>
+<p>Please confirm your email address ({{.Email}}) by following this link:</p>
+<p><a href="{{.Link}}">Confirm my email address</a></p>
+<p>If you didn't ask to sign up, you can ignore this email.</p>
+`,
+		},
+		"registered": {
+			Subject: "You already have an account",
+			Text: `Hello {{.Name}},
+
+Someone asked to sign up with {{.Email}}, but there's already an account with
+that address.  If it was you, you can sign in as usual, or ask to reset your
+password if you've forgotten it.
+
+If it wasn't you, you can ignore this email.
+`,
+			HTML: `<p>Hello {{.Name}},</p>
+<p>Someone asked to sign up with {{.Email}}, but there's already an account with that address.  If it was you, you can sign in as usual, or ask to reset your password if you've forgotten it.</p>
+<p>If it wasn't you, you can ignore this email.</p>
+`,
+		},
+		"reset": {
+			Subject: "Reset your password",
+			Text: `Hello {{.Name}},
+
+Someone asked to reset the password for {{.Email}}.  To choose a new password,
+follow this link:
+
+{{.Link}}
+
+If it wasn't you, you can ignore this email and your password won't change.
+`,
+			HTML: `<p>Hello {{.Name}},</p>
+<p>Someone asked to reset the password for {{.Email}}.  To choose a new password, follow this link:</p>
+<p><a href="{{.Link}}">Reset my password</a></p>
+<p>If it wasn't you, you can ignore this email and your password won't change.</p>
+`,
+		},
+		"password-changed": {
+			Subject: "Your password was changed",
+			Text: `Hello {{.Name}},
+
+The password for {{.Email}} was just changed.  If you did this, there's nothing
+more to do.  If you didn't, please reset your password right away.
+`,
+			HTML: `<p>Hello {{.Name}},</p>
+<p>The password for {{.Email}} was just changed.  If you did this, there's nothing more to do.  If you didn't, please reset your password right away.</p>
+`,
+		},
+		"signin": {
+			Subject: "Your sign-in link",
+			Text: `Hello {{.Name}},
+
+To sign in as {{.Email}}, follow this link.  It can only be used once.
+
+{{.Link}}
+
+If you didn't ask to sign in, you can ignore this email.
+`,
+			HTML: `<p>Hello {{.Name}},</p>
+<p>To sign in as {{.Email}}, follow this link.  It can only be used once.</p>
+<p><a href="{{.Link}}">Sign me in</a></p>
+<p>If you didn't ask to sign in, you can ignore this email.</p>
+`,
+		},
+	},
+	"ms": {
+		"verify": {
+			Subject: "Sahkan alamat e-mel anda",
+			Text: `Helo,
+
+Sila sahkan alamat e-mel anda ({{.Email}}) dengan mengikuti pautan ini:
+
+{{.Link}}
+
+Jika anda tidak meminta untuk mendaftar, abaikan e-mel ini.
+`,
+			HTML: `<p>Helo,</p>
+<p>Sila sahkan alamat e-mel anda ({{.Email}}) dengan mengikuti pautan ini:</p>
+<p><a href="{{.Link}}">Sahkan alamat e-mel saya</a></p>
+<p>Jika anda tidak meminta untuk mendaftar, abaikan e-mel ini.</p>
+`,
+		},
+		"registered": {
+			Subject: "Anda sudah mempunyai akaun",
+			Text: `Helo {{.Name}},
+
+Seseorang telah meminta untuk mendaftar dengan {{.Email}}, tetapi alamat itu
+sudah mempunyai akaun.  Jika itu anda, anda boleh log masuk seperti biasa,
+atau meminta untuk menetapkan semula kata laluan anda jika anda terlupa.
+
+Jika bukan anda, abaikan e-mel ini.
+`,
+			HTML: `<p>Helo {{.Name}},</p>
+<p>Seseorang telah meminta untuk mendaftar dengan {{.Email}}, tetapi alamat itu sudah mempunyai akaun.  Jika itu anda, anda boleh log masuk seperti biasa, atau meminta untuk menetapkan semula kata laluan anda jika anda terlupa.</p>
+<p>Jika bukan anda, abaikan e-mel ini.</p>
+`,
+		},
+		"reset": {
+			Subject: "Tetapkan semula kata laluan anda",
+			Text: `Helo {{.Name}},
+
+Seseorang telah meminta untuk menetapkan semula kata laluan bagi {{.Email}}.
+Untuk memilih kata laluan baharu, ikuti pautan ini:
+
+{{.Link}}
+
+Jika bukan anda, abaikan e-mel ini dan kata laluan anda tidak akan berubah.
+`,
+			HTML: `<p>Helo {{.Name}},</p>
+<p>Seseorang telah meminta untuk menetapkan semula kata laluan bagi {{.Email}}.  Untuk memilih kata laluan baharu, ikuti pautan ini:</p>
+<p><a href="{{.Link}}">Tetapkan semula kata laluan saya</a></p>
+<p>Jika bukan anda, abaikan e-mel ini dan kata laluan anda tidak akan berubah.</p>
+`,
+		},
+		"password-changed": {
+			Subject: "Kata laluan anda telah ditukar",
+			Text: `Helo {{.Name}},
+
+Kata laluan bagi {{.Email}} baru sahaja ditukar.  Jika anda yang melakukannya,
+tiada apa-apa lagi yang perlu dilakukan.  Jika bukan, sila tetapkan semula kata
+laluan anda dengan segera.
+`,
+			HTML: `<p>Helo {{.Name}},</p>
+<p>Kata laluan bagi {{.Email}} baru sahaja ditukar.  Jika anda yang melakukannya, tiada apa-apa lagi yang perlu dilakukan.  Jika bukan, sila tetapkan semula kata laluan anda dengan segera.</p>
+`,
+		},
+		"signin": {
+			Subject: "Pautan log masuk anda",
+			Text: `Helo {{.Name}},
+
+Untuk log masuk sebagai {{.Email}}, ikuti pautan ini.  Pautan ini hanya boleh
+digunakan sekali.
+
+{{.Link}}
+
+Jika anda tidak meminta untuk log masuk, abaikan e-mel ini.
+`,
+			HTML: `<p>Helo {{.Name}},</p>
+<p>Untuk log masuk sebagai {{.Email}}, ikuti pautan ini.  Pautan ini hanya boleh digunakan sekali.</p>
+<p><a href="{{.Link}}">Log masuk</a></p>
+<p>Jika anda tidak meminta untuk log masuk, abaikan e-mel ini.</p>
+`,
+		},
+	},
+}
+
+// SetMailTemplate adds or replaces the template for one kind of email in one
+// language.  subject and text use text/template and html uses html/template,
+// with .Name, .Email and .Link available.  Call this before handling any
+// requests.
+func SetMailTemplate(lang, name, subject, text, html string) {
+	if mailTemplates[lang] == nil {
+		mailTemplates[lang] = make(map[string]mailTemplate)
+	}
+	mailTemplates[lang][name] = mailTemplate{subject, text, html}
+}
+
+// findTemplate picks the template for a kind of email in the language that
+// best matches lang, which is a language tag such as "en-GB".
+func findTemplate(lang, name string) mailTemplate {
+	lang = strings.ToLower(lang)
+	for _, l := range []string{lang, strings.SplitN(lang, "-", 2)[0], defaultLanguage} {
+		if t, ok := mailTemplates[l][name]; ok {
+			return t
+		}
+	}
+	panic("sso: no mail template named " + name)
+}
+
+// sendMail renders one of our emails and sends it.
+func sendMail(lang, name, to string, data *mailData) error {
+
+	mt := findTemplate(lang, name)
+	msg := &Message{From: MailFrom, To: to}
+
+	var b bytes.Buffer
+	for _, part := range []struct {
+		tmpl string
+		out  *string
+	}{{mt.Subject, &msg.Subject}, {mt.Text, &msg.Text}} {
+		t, err := template.New(name).Parse(part.tmpl)
+		if err != nil {
+			return err
+		}
+		b.Reset()
+		if err := t.Execute(&b, data); err != nil {
+			return err
+		}
+		*part.out = b.String()
+	}
+
+	if mt.HTML != "" {
+		t, err := htmltemplate.New(name).Parse(mt.HTML)
+		if err != nil {
+			return err
+		}
+		b.Reset()
+		if err := t.Execute(&b, data); err != nil {
+			return err
+		}
+		msg.HTML = b.String()
+	}
+
+	return mailer.Send(msg)
+}
@@ -0,0 +1,138 @@
+package sso
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type Message is an email ready to send.  HTML may be empty.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Type Mailer sends email.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// Mail settings.  MailFrom is the sender of all our email.  VerifyURL is the
+// page that verify codes are sent to, as a vcode parameter.
+var (
+	MailFrom  = "noreply@localhost"
+	VerifyURL = "http://localhost:8000/verify"
+)
+
+var mailer Mailer = &LogMailer{}
+
+// SetMailer sets the Mailer used for all email.  The default is a LogMailer,
+// which is only suitable for development.
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+// Type SMTPMailer sends email through an SMTP server.  Auth may be nil if the
+// server doesn't need it.
+type SMTPMailer struct {
+	Addr string // host:port
+	Auth smtp.Auth
+}
+
+// Send implements Mailer.
+func (s *SMTPMailer) Send(msg *Message) error {
+	return smtp.SendMail(s.Addr, s.Auth, msg.From, []string{msg.To}, msg.Bytes())
+}
+
+// Type LogMailer doesn't send email at all.  If Dir is set, each message is
+// written to a .eml file there; otherwise messages are written to the log.
+type LogMailer struct {
+	Dir string
+}
+
+// Send implements Mailer.
+func (l *LogMailer) Send(msg *Message) error {
+	if l.Dir == "" {
+		log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+		return nil
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), RandomToken(6))
+	return ioutil.WriteFile(filepath.Join(l.Dir, name), msg.Bytes(), 0600)
+}
+
+// Type MemoryMailer keeps messages in memory instead of sending them, so that
+// tests can look at them.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []*Message
+}
+
+// Send implements Mailer.
+func (mm *MemoryMailer) Send(msg *Message) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.sent = append(mm.sent, msg)
+	return nil
+}
+
+// Sent returns all messages sent so far.
+func (mm *MemoryMailer) Sent() []*Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return append([]*Message(nil), mm.sent...)
+}
+
+// Last returns the last message sent to the address, or nil if there isn't
+// one.
+func (mm *MemoryMailer) Last(to string) *Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for i := len(mm.sent) - 1; i >= 0; i-- {
+		if mm.sent[i].To == to {
+			return mm.sent[i]
+		}
+	}
+	return nil
+}
+
+// Bytes formats the message for sending, as multipart/alternative if it has
+// an HTML part.
+func (msg *Message) Bytes() []byte {
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\n",
+		msg.From, msg.To, mime.BEncoding.Encode("utf-8", msg.Subject))
+
+	if msg.HTML == "" {
+		writePart(&b, "text/plain", msg.Text)
+		return b.Bytes()
+	}
+
+	boundary := "fsso-" + RandomToken(24)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	writePart(&b, "text/plain", msg.Text)
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	writePart(&b, "text/html", msg.HTML)
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes()
+}
+
+// writePart writes the headers and quoted-printable body of one part.
+func writePart(b *bytes.Buffer, contentType, body string) {
+	fmt.Fprintf(b, "Content-Type: %s; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n", contentType)
+	qp := quotedprintable.NewWriter(b)
+	qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	qp.Close()
+}
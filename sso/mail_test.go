@@ -0,0 +1,125 @@
+package sso
+
+import (
+	"strings"
+	"testing"
+)
+
+// testMailer sends mail to a MemoryMailer for the rest of the test.
+func testMailer(t *testing.T) *MemoryMailer {
+	t.Helper()
+	old := mailer
+	mm := &MemoryMailer{}
+	SetMailer(mm)
+	t.Cleanup(func() { SetMailer(old) })
+	return mm
+}
+
+func TestSendMail(t *testing.T) {
+
+	mm := testMailer(t)
+	data := &mailData{Name: "<Ada>", Email: "ada@example.com", Link: "https://example.com/verify?vcode=a&b"}
+	if err := sendMail("en", "reset", "ada@example.com", data); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := mm.Last("ada@example.com")
+	if msg == nil || len(mm.Sent()) != 1 {
+		t.Fatalf("sent %v", mm.Sent())
+	}
+	if msg.From != MailFrom || msg.Subject != "Reset your password" {
+		t.Errorf("got %+v", msg)
+	}
+	// The text part is as is, but the HTML part is escaped.
+	if !strings.Contains(msg.Text, "Hello <Ada>,") || !strings.Contains(msg.Text, data.Link+"\n") {
+		t.Errorf("text: %s", msg.Text)
+	}
+	if !strings.Contains(msg.HTML, "Hello &lt;Ada&gt;,") || !strings.Contains(msg.HTML, `href="https://example.com/verify?vcode=a&amp;b"`) {
+		t.Errorf("html: %s", msg.HTML)
+	}
+	if mm.Last("other@example.com") != nil {
+		t.Error("mail for someone else")
+	}
+}
+
+func TestMailLanguage(t *testing.T) {
+
+	mm := testMailer(t)
+	SetMailTemplate("fr", "signin", "Votre lien de connexion", "Bonjour {{.Name}}", "")
+	defer delete(mailTemplates, "fr")
+
+	tests := map[string]string{
+		"en":    "Your sign-in link",
+		"en-GB": "Your sign-in link",
+		"ms":    "Pautan log masuk anda",
+		"MS-my": "Pautan log masuk anda",
+		"fr-CA": "Votre lien de connexion",
+		"de":    "Your sign-in link",
+		"":      "Your sign-in link",
+	}
+	for lang, want := range tests {
+		if err := sendMail(lang, "signin", "ada@example.com", &mailData{Name: "Ada"}); err != nil {
+			t.Fatalf("%s: %v", lang, err)
+		}
+		if msg := mm.Last("ada@example.com"); msg.Subject != want {
+			t.Errorf("%q: got %q, want %q", lang, msg.Subject, want)
+		}
+	}
+
+	// A template without an HTML part makes a plain text email.
+	sendMail("fr", "signin", "ada@example.com", &mailData{Name: "Ada"})
+	msg := mm.Last("ada@example.com")
+	if msg.Text != "Bonjour Ada" || msg.HTML != "" || strings.Contains(string(msg.Bytes()), "multipart") {
+		t.Errorf("got %+v", msg)
+	}
+}
+
+func TestMailTemplatesComplete(t *testing.T) {
+
+	// Every language has every kind of email that English has.
+	for lang, templates := range mailTemplates {
+		for name := range mailTemplates[defaultLanguage] {
+			if _, ok := templates[name]; !ok {
+				t.Errorf("%s: no %s template", lang, name)
+			}
+		}
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+
+	msg := &Message{From: "a@example.com", To: "b@example.com", Subject: "Sélection", Text: "text\n", HTML: "<p>html</p>"}
+	b := string(msg.Bytes())
+	for _, want := range []string{
+		"To: b@example.com\r\n",
+		"Subject: =?utf-8?b?",
+		"Content-Type: multipart/alternative; boundary=fsso-",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"Content-Type: text/html; charset=utf-8\r\n",
+		"text\r\n",
+	} {
+		if !strings.Contains(b, want) {
+			t.Errorf("no %q in\n%s", want, b)
+		}
+	}
+}
+
+func TestPlausibleEmail(t *testing.T) {
+
+	tests := map[string]bool{
+		"ada@example.com":                       true,
+		"o'brien+tag@example.co.uk":             true,
+		"@example.com":                          false,
+		"ada@":                                  false,
+		"ada":                                   false,
+		"ada@b@example.com":                     false,
+		"ada@example.com\r\nBcc: x@example.com": false,
+		"ada@example.com\nBcc: x@example.com":   false,
+		"ada@example.com\rBcc: x@example.com":   false,
+	}
+	for email, want := range tests {
+		if got := plausibleEmail(email); got != want {
+			t.Errorf("%q: got %v", email, got)
+		}
+	}
+}
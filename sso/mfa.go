@@ -0,0 +1,428 @@
+package sso
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"net/http"
+	"strings"
+)
+
+// Two-factor authentication settings.  Members with any of MfaRequiredRoles
+// only have those roles in sessions that passed two-factor authentication.
+// MfaChallengeLifetime is the number of seconds a member has to enter their
+// code after the first step of signing in.
+var (
+	MfaRequiredRoles     uint32
+	MfaChallengeLifetime int64 = 300
+	RecoveryCodeCount          = 10
+)
+
+// mfaMaxAttempts is the number of wrong codes allowed per challenge.
+const mfaMaxAttempts = 5
+
+// Type TOTPEnrollment is returned when a member starts setting up an
+// authenticator app.  URI is usually shown as a QR code, with Secret for
+// typing in by hand.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// EnrollTOTP starts setting up an authenticator app for the member.  It
+// doesn't take effect until confirmed with ConfirmTOTP.  Starting again
+// before confirming replaces the secret.  A second factor is a way to sign
+// in, so the member must have reauthenticated recently (see
+// requireRecentAuth).
+func (m *Member) EnrollTOTP() (*TOTPEnrollment, error) {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return nil, err
+	}
+
+	secret := newTOTPSecret()
+
+	err := inTx(func(t *sql.Tx) error {
+		var confirmed bool
+		err := t.QueryRow(
+			"SELECT is_confirmed FROM "+totpTable+" WHERE member_id=? FOR UPDATE",
+			m.id).Scan(&confirmed)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if confirmed {
+			return ErrMfaEnrolled
+		}
+		_, err = t.Exec(
+			"REPLACE INTO "+totpTable+" (member_id, secret, is_confirmed, last_step, created_at) VALUES (?,?,0,0,?)",
+			m.id, secret, timestamp())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{Secret: secret, URI: totpURI(secret, m.Email)}, nil
+}
+
+// ConfirmTOTP finishes setting up an authenticator app, given a code from it,
+// and returns a new set of recovery codes.  The recovery codes are only
+// stored hashed, so this is the only chance to show them to the member.
+//
+// Since the member has just shown that they have the second factor, the
+// current session counts as having passed two-factor authentication.
+func (m *Member) ConfirmTOTP(code string) ([]string, error) {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+
+	err := inTx(func(t *sql.Tx) error {
+
+		var (
+			secret    string
+			confirmed bool
+		)
+		if err := t.QueryRow(
+			"SELECT secret, is_confirmed FROM "+totpTable+" WHERE member_id=? FOR UPDATE",
+			m.id).Scan(&secret, &confirmed); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrMfaNotEnrolled
+			}
+			return err
+		}
+		if confirmed {
+			return ErrMfaEnrolled
+		}
+
+		step, err := totpMatch(secret, code, timestamp(), 0)
+		if err != nil {
+			return err
+		}
+		if step < 0 {
+			return ErrInvalidMfaCode
+		}
+
+		if _, err := t.Exec(
+			"UPDATE "+totpTable+" SET is_confirmed=1, last_step=? WHERE member_id=?",
+			step, m.id); err != nil {
+			return err
+		}
+		if codes, err = newRecoveryCodes(t, m.id); err != nil {
+			return err
+		}
+		_, err = t.Exec(
+			"UPDATE "+activeTable+" SET is_mfa=1 WHERE atoken=?",
+			m.aToken)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.mfa = true
+	return codes, nil
+}
+
+// DisableTOTP removes the member's authenticator app and recovery codes,
+// given a code from either.  As with enrolling, the member must have
+// reauthenticated recently, and wrong codes count against them in Lockout.
+func (m *Member) DisableTOTP(code string) error {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return err
+	}
+
+	key := memberKey(m.id)
+	if Lockout != nil {
+		if err := Lockout.check(key); err != nil {
+			return err
+		}
+	}
+	if err := codeCheck(code)(m.id); err != nil {
+		mfaFailed(key, err)
+		return err
+	}
+	if Lockout != nil {
+		Lockout.reset(key)
+	}
+
+	return inTx(func(t *sql.Tx) error {
+		if _, err := t.Exec(
+			"DELETE FROM "+totpTable+" WHERE member_id=?",
+			m.id); err != nil {
+			return err
+		}
+		_, err := t.Exec(
+			"DELETE FROM "+recoveryTable+" WHERE member_id=?",
+			m.id)
+		return err
+	})
+}
+
+// MfaVerified returns true if the member's session passed two-factor
+// authentication.
+func (m *Member) MfaVerified() bool {
+	return m.mfa
+}
+
+// SigninMFA finishes signing in a member who has two-factor authentication,
+// given the mtoken from SigninEmail or SigninSocial and a code from the
+// member's authenticator app or one of their recovery codes.
+func SigninMFA(r *http.Request, mtoken, code string) (*SigninReply, error) {
+	m, err := passChallenge(mtoken, true, codeCheck(code))
+	if err != nil {
+		return nil, err
+	}
+	return openSession(r, m)
+}
+
+// ConnectMFA is like SigninMFA, for the mtoken from ConnectEmail or
+// ConnectSocial.
+func ConnectMFA(r *http.Request, mtoken, code string) (*ConnectReply, error) {
+	m, err := passChallenge(mtoken, false, codeCheck(code))
+	if err != nil {
+		return nil, err
+	}
+	return openConnection(r, m)
+}
+
+// Type mfaChallenge is a pending second step of signing in.  Methods lists
+// the second factors the member has: "totp" and/or "webauthn".
+type mfaChallenge struct {
+	mtoken  string
+	expiry  int64
+	methods []string
+}
+
+// newChallenge starts the second step of signing in for a member who has
+// two-factor authentication.  isSession tells whether a cookie session or a
+// token-based session is being signed in to.  Returns nil if the member
+// doesn't have two-factor authentication.
+func newChallenge(mid int64, isSession bool) (*mfaChallenge, error) {
+
+	methods, err := mfaMethods(mid)
+	if err != nil {
+		return nil, err
+	}
+	if len(methods) == 0 {
+		return nil, nil
+	}
+	c := &mfaChallenge{expiry: timestamp() + MfaChallengeLifetime, methods: methods}
+
+	for {
+		c.mtoken = RandomToken(32)
+		if _, err := db.Exec(
+			"INSERT INTO "+mfaChallengeTable+" (mtoken, member_id, is_session, attempts, expires_at) VALUES (?,?,?,0,?)",
+			c.mtoken, mid, isSession, c.expiry); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// mfaMethods lists the second factors the member has, if any.
+func mfaMethods(mid int64) ([]string, error) {
+
+	var totp, passkeys int
+	if err := db.QueryRow(
+		"SELECT (SELECT COUNT(*) FROM "+totpTable+" WHERE member_id=? AND is_confirmed=1), "+
+			"(SELECT COUNT(*) FROM "+webauthnAuthTable+" WHERE member_id=?)",
+		mid, mid).Scan(&totp, &passkeys); err != nil {
+		return nil, err
+	}
+
+	var methods []string
+	if totp > 0 {
+		methods = append(methods, "totp")
+	}
+	if passkeys > 0 {
+		methods = append(methods, "webauthn")
+	}
+	return methods, nil
+}
+
+// codeCheck returns a check for passChallenge that code is from the member's
+// authenticator app or is one of their recovery codes.
+func codeCheck(code string) func(int64) error {
+	return func(mid int64) error {
+		ok, err := checkMfaCode(mid, code)
+		if err == nil && !ok {
+			err = ErrInvalidMfaCode
+		}
+		return err
+	}
+}
+
+// passChallenge checks the second factor for a challenge with check, and on
+// success uses up the challenge and returns the member, marked as having
+// passed two-factor authentication.  check returns an ErrorResponse if the
+// second factor is wrong.  Only a few attempts are allowed per challenge,
+// and wrong ones count against the member in Lockout, so that signing in
+// again for a fresh challenge doesn't give unlimited guesses.
+func passChallenge(mtoken string, isSession bool, check func(mid int64) error) (*Member, error) {
+
+	var (
+		mid     int64
+		session bool
+	)
+	if err := db.QueryRow(
+		"SELECT member_id, is_session FROM "+mfaChallengeTable+" WHERE mtoken=?",
+		mtoken).Scan(&mid, &session); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidMfaToken
+		}
+		return nil, err
+	}
+	if session != isSession {
+		return nil, ErrInvalidMfaToken
+	}
+
+	key := memberKey(mid)
+	if Lockout != nil {
+		if err := Lockout.check(key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Claim an attempt before checking, so that parallel requests can't get
+	// more than their share.
+	res, err := db.Exec(
+		"UPDATE "+mfaChallengeTable+" SET attempts=attempts+1 WHERE mtoken=? AND attempts<? AND expires_at>=?",
+		mtoken, mfaMaxAttempts, timestamp())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrInvalidMfaToken
+	}
+
+	if failure := check(mid); failure != nil {
+		mfaFailed(key, failure)
+		return nil, failure
+	}
+
+	res, err = db.Exec("DELETE FROM "+mfaChallengeTable+" WHERE mtoken=?", mtoken)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Someone else got there first.
+		return nil, ErrInvalidMfaToken
+	}
+	if Lockout != nil {
+		Lockout.reset(key)
+	}
+
+	m, err := getMember(mid)
+	if err != nil {
+		return nil, err
+	}
+	m.mfa = true
+	return m, nil
+}
+
+// mfaFailed counts a failed check of the member's second factor against them
+// in Lockout, unless it failed for some reason other than a wrong answer.
+func mfaFailed(key string, failure error) {
+	if _, ok := failure.(ErrorResponse); ok && Lockout != nil {
+		Lockout.failKey(key, Lockout.AccountAttempts)
+	}
+}
+
+// checkMfaCode checks a code from the member's authenticator app or one of
+// their recovery codes.  Either kind of code only works once.
+func checkMfaCode(mid int64, code string) (bool, error) {
+
+	var (
+		secret   string
+		lastStep int64
+	)
+	if err := db.QueryRow(
+		"SELECT secret, last_step FROM "+totpTable+" WHERE member_id=? AND is_confirmed=1",
+		mid).Scan(&secret, &lastStep); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	step, err := totpMatch(secret, code, timestamp(), lastStep)
+	if err != nil {
+		return false, err
+	}
+	if step >= 0 {
+		res, err := db.Exec(
+			"UPDATE "+totpTable+" SET last_step=? WHERE member_id=? AND last_step<?",
+			step, mid, step)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	res, err := db.Exec(
+		"DELETE FROM "+recoveryTable+" WHERE member_id=? AND code_hash=?",
+		mid, hashSecret(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// recoveryAlphabet is Crockford's base32, which leaves out letters that are
+// easily mistaken for digits.  Having 32 characters means each random byte
+// maps onto it evenly.
+const recoveryAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// newRecoveryCodes replaces the member's recovery codes with a new set, and
+// returns them.  Codes look like xxxxx-xxxxx.
+func newRecoveryCodes(ex execer, mid int64) ([]string, error) {
+
+	if _, err := ex.Exec(
+		"DELETE FROM "+recoveryTable+" WHERE member_id=?",
+		mid); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = recoveryAlphabet[int(b[j])%len(recoveryAlphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		if _, err := ex.Exec(
+			"INSERT INTO "+recoveryTable+" (member_id, code_hash) VALUES (?,?)",
+			mid, hashSecret(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes, and reads letters
+// that look like digits as those digits, since people tend to get these wrong
+// when typing codes in.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(c rune) rune {
+		switch c {
+		case ' ', '-':
+			return -1
+		case 'o':
+			return '0'
+		case 'i', 'l':
+			return '1'
+		}
+		return c
+	}, strings.ToLower(code))
+}
@@ -13,6 +13,7 @@
 
 --
 -- One entry per registered user.  Additional fields may be added as needed.
+-- delete_at is when the member is due to be deleted, or 0 if they aren't.
 --
 CREATE TABLE `fsso_members` (
   `id` serial,
@@ -22,7 +23,9 @@ CREATE TABLE `fsso_members` (
   `is_active` boolean NOT NULL DEFAULT 1,
   `roles` int(10) unsigned NOT NULL DEFAULT 0,
   `created_at` bigint(20) NOT NULL,
-  `active_at` bigint(20) NOT NULL
+  `active_at` bigint(20) NOT NULL,
+  `delete_at` bigint(20) NOT NULL DEFAULT 0,
+  KEY `delete_at` (`delete_at`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
 --
@@ -31,7 +34,7 @@ CREATE TABLE `fsso_members` (
 CREATE TABLE `fsso_auth_email` (
   `member_id` bigint(20) unsigned NOT NULL PRIMARY KEY,
   `email` varchar(255) NOT NULL UNIQUE,
-  `pwhash` varchar(64) NOT NULL,
+  `pwhash` varchar(255) NOT NULL,
   `pwchanged_at` bigint(20) NOT NULL,
   `is_primary` boolean NOT NULL DEFAULT 1,
   CONSTRAINT `fsso_auth_email_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
@@ -61,19 +64,42 @@ CREATE TABLE `fsso_auth_fb` (
   CONSTRAINT `fsso_auth_fb_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
+--
+-- One entry per registered user per OpenID Connect identity provider (such as
+-- Keycloak) that they sign in with.  Providers are told apart by issuer.
+--
+CREATE TABLE `fsso_auth_oidc` (
+  `member_id` bigint(20) unsigned NOT NULL,
+  `issuer` varchar(255) NOT NULL,
+  `uid` varchar(255) NOT NULL,
+  `email` varchar(255) NOT NULL,
+  `is_primary` boolean NOT NULL DEFAULT 1,
+  PRIMARY KEY (`member_id`, `issuer`),
+  UNIQUE KEY `issuer_uid` (`issuer`, `uid`),
+  KEY `email` (`email`),
+  CONSTRAINT `fsso_auth_oidc_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
 --
 -- One entry per sign-in session.  One user may have more than one session active.
 -- is_session is 1 for cooke-based sessions and 0 for token-based sessions.
+-- created_at is when the member signed in; sessions renewed with a refresh
+-- token keep the time of the original signin.
 --
 CREATE TABLE `fsso_active` (
   `atoken` varchar(32) NOT NULL PRIMARY KEY,
   `member_id` bigint(20) unsigned NOT NULL,
+  `created_at` bigint(20) NOT NULL,
   `active_at` bigint(20) NOT NULL,
+  `reauth_at` bigint(20) NOT NULL,
   `useragent` varchar(50) NOT NULL,
   `ip` varchar(50) NOT NULL,
   `is_session` boolean NOT NULL,
+  `is_mfa` boolean NOT NULL DEFAULT 0,
   `data` text NOT NULL,
   KEY `member_id` (`member_id`),
+  KEY `created_at` (`created_at`),
+  KEY `active_at` (`active_at`),
   CONSTRAINT `fsso_active_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
@@ -84,10 +110,64 @@ CREATE TABLE `fsso_active` (
 CREATE TABLE `fsso_refresh` (
   `rtoken` varchar(32) NOT NULL PRIMARY KEY,
   `member_id` bigint(20) unsigned NOT NULL UNIQUE,
+  `is_mfa` boolean NOT NULL DEFAULT 0,
+  `signin_at` bigint(20) NOT NULL,
   `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`),
   CONSTRAINT `fsso_refresh_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
+--
+-- One entry per refresh token that has already been used, kept until the token
+-- would have expired.  A used token that is presented again indicates theft.
+--
+CREATE TABLE `fsso_refresh_used` (
+  `rtoken` varchar(32) NOT NULL PRIMARY KEY,
+  `member_id` bigint(20) unsigned NOT NULL,
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`),
+  KEY `member_id` (`member_id`),
+  CONSTRAINT `fsso_refresh_used_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per password reset link sent out.  Each may only be used once.
+--
+CREATE TABLE `fsso_password_reset` (
+  `ptoken` varchar(32) NOT NULL PRIMARY KEY,
+  `member_id` bigint(20) unsigned NOT NULL,
+  `email` varchar(255) NOT NULL,
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`),
+  KEY `member_id` (`member_id`),
+  CONSTRAINT `fsso_password_reset_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per authorization code flow in progress.  The state is passed to
+-- the provider and back, and may only be used once.
+--
+CREATE TABLE `fsso_oauth_state` (
+  `state` varchar(32) NOT NULL PRIMARY KEY,
+  `provider` varchar(50) NOT NULL,
+  `verifier` varchar(64) NOT NULL,
+  `nonce` varchar(32) NOT NULL,
+  `redirect_uri` varchar(255) NOT NULL,
+  `return_to` varchar(255) NOT NULL,
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per nonce issued for a client to request an ID token with.  Each
+-- may only be used once.
+--
+CREATE TABLE `fsso_nonce` (
+  `nonce` varchar(32) NOT NULL PRIMARY KEY,
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
 --
 -- One entry per email address awaiting verification.
 -- Anyone in possesion of vtoken is assumed to own the email address.
@@ -95,5 +175,133 @@ CREATE TABLE `fsso_refresh` (
 CREATE TABLE `fsso_email_verify` (
   `vtoken` varchar(32) NOT NULL PRIMARY KEY,
   `email` varchar(255) NOT NULL,
-  `expires_at` bigint(20) NOT NULL
+  `purpose` varchar(10) NOT NULL DEFAULT 'register',
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per application that signs its users in through fsso, with fsso
+-- acting as an OpenID Connect provider.  redirect_uris is the allow-list of
+-- places users may be sent back to, one per line.
+--
+CREATE TABLE `fsso_oidc_clients` (
+  `client_id` varchar(32) NOT NULL PRIMARY KEY,
+  `secret_hash` varchar(64) NOT NULL,
+  `name` varchar(50) NOT NULL,
+  `redirect_uris` text NOT NULL,
+  `created_at` bigint(20) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per authorization code issued to a client and not yet exchanged.
+--
+CREATE TABLE `fsso_oidc_codes` (
+  `code` varchar(32) NOT NULL PRIMARY KEY,
+  `client_id` varchar(32) NOT NULL,
+  `member_id` bigint(20) unsigned NOT NULL,
+  `is_mfa` boolean NOT NULL DEFAULT 0,
+  `auth_time` bigint(20) NOT NULL,
+  `redirect_uri` varchar(255) NOT NULL,
+  `scope` varchar(255) NOT NULL,
+  `nonce` varchar(255) NOT NULL,
+  `challenge` varchar(64) NOT NULL,
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`),
+  CONSTRAINT `fsso_oidc_codes_ibfk_1` FOREIGN KEY (`client_id`) REFERENCES `fsso_oidc_clients` (`client_id`) ON DELETE CASCADE,
+  CONSTRAINT `fsso_oidc_codes_ibfk_2` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per access token issued to a client.  Only a hash of the token is
+-- stored.
+--
+CREATE TABLE `fsso_oidc_tokens` (
+  `token_hash` varchar(64) NOT NULL PRIMARY KEY,
+  `client_id` varchar(32) NOT NULL,
+  `member_id` bigint(20) unsigned NOT NULL,
+  `is_mfa` boolean NOT NULL DEFAULT 0,
+  `scope` varchar(255) NOT NULL,
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`),
+  KEY `member_id` (`member_id`),
+  CONSTRAINT `fsso_oidc_tokens_ibfk_1` FOREIGN KEY (`client_id`) REFERENCES `fsso_oidc_clients` (`client_id`) ON DELETE CASCADE,
+  CONSTRAINT `fsso_oidc_tokens_ibfk_2` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- Failed signin attempts, by account ("email:" + address) or by client IP
+-- ("ip:" + address).  Used by MySQLCounter.  fkey is a sha256 hash of the key.
+--
+CREATE TABLE `fsso_auth_failures` (
+  `fkey` char(64) NOT NULL PRIMARY KEY,
+  `failures` int(11) NOT NULL,
+  `failed_at` bigint(20) NOT NULL,
+  `locked_until` bigint(20) NOT NULL,
+  KEY `failed_at` (`failed_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per member who has set up an authenticator app (TOTP).  The
+-- entry isn't used for signing in until it's confirmed.  last_step is the
+-- last time step whose code was accepted, so that codes can't be replayed.
+--
+CREATE TABLE `fsso_mfa_totp` (
+  `member_id` bigint(20) unsigned NOT NULL PRIMARY KEY,
+  `secret` varchar(64) NOT NULL,
+  `is_confirmed` boolean NOT NULL DEFAULT 0,
+  `last_step` bigint(20) NOT NULL,
+  `created_at` bigint(20) NOT NULL,
+  CONSTRAINT `fsso_mfa_totp_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- Unused two-factor recovery codes.  Only a hash of each code is stored.
+--
+CREATE TABLE `fsso_mfa_recovery` (
+  `member_id` bigint(20) unsigned NOT NULL,
+  `code_hash` varchar(64) NOT NULL,
+  PRIMARY KEY (`member_id`, `code_hash`),
+  CONSTRAINT `fsso_mfa_recovery_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per signin waiting for its second factor.
+--
+CREATE TABLE `fsso_mfa_challenge` (
+  `mtoken` varchar(32) NOT NULL PRIMARY KEY,
+  `member_id` bigint(20) unsigned NOT NULL,
+  `is_session` boolean NOT NULL,
+  `attempts` int(11) NOT NULL,
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`),
+  CONSTRAINT `fsso_mfa_challenge_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- One entry per WebAuthn credential (passkey).  public_key is the COSE_Key
+-- from the authenticator.  sign_count is the last signature counter seen.
+--
+CREATE TABLE `fsso_auth_webauthn` (
+  `credential_id` varchar(255) NOT NULL PRIMARY KEY,
+  `member_id` bigint(20) unsigned NOT NULL,
+  `public_key` blob NOT NULL,
+  `sign_count` bigint(20) unsigned NOT NULL,
+  `name` varchar(50) NOT NULL,
+  `created_at` bigint(20) NOT NULL,
+  `used_at` bigint(20) NOT NULL,
+  KEY `member_id` (`member_id`),
+  CONSTRAINT `fsso_auth_webauthn_ibfk_1` FOREIGN KEY (`member_id`) REFERENCES `fsso_members` (`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+--
+-- Outstanding WebAuthn challenges.  member_id is 0 for signin challenges that
+-- any passkey may answer.  purpose is "create" or "get".
+--
+CREATE TABLE `fsso_webauthn_challenge` (
+  `challenge` varchar(64) NOT NULL PRIMARY KEY,
+  `member_id` bigint(20) unsigned NOT NULL,
+  `purpose` varchar(10) NOT NULL,
+  `expires_at` bigint(20) NOT NULL,
+  KEY `expires_at` (`expires_at`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
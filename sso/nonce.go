@@ -0,0 +1,62 @@
+package sso
+
+// NonceLifetime is the number of seconds a nonce from NewNonce remains valid.
+var NonceLifetime int64 = 600
+
+// NewNonce issues a nonce for the client to put in its request to an
+// identity provider, and returns it along with its expiry time.  The ID token
+// that comes back carries the nonce, and is only accepted along with it, once;
+// so a stolen ID token can't be replayed.
+func NewNonce() (string, int64, error) {
+	expiry := timestamp() + NonceLifetime
+	for {
+		nonce := RandomToken(32)
+		if _, err := db.Exec(
+			"INSERT INTO "+nonceTable+" (nonce, expires_at) VALUES (?,?)",
+			nonce, expiry); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return "", 0, err
+		}
+		return nonce, expiry, nil
+	}
+}
+
+// verifySocial validates a token from the named provider, along with the
+// nonce from NewNonce that it was requested with, and uses up the nonce.
+// Providers whose tokens carry a nonce (see NonceProvider) require one;
+// others, such as Facebook, have no protection against replay beyond the
+// token's own expiry, and nonce must be "".
+func verifySocial(provider, token, nonce string) (Provider, *Identity, error) {
+
+	p := GetProvider(provider)
+	if p == nil {
+		return nil, nil, ErrUnknownProvider
+	}
+	id, err := p.Verify(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id.Nonce != nonce {
+		return nil, nil, ErrInvalidItoken
+	}
+
+	if nonce == "" {
+		if _, ok := p.(NonceProvider); ok {
+			return nil, nil, ErrInvalidItoken
+		}
+		return p, id, nil
+	}
+
+	res, err := db.Exec(
+		"DELETE FROM "+nonceTable+" WHERE nonce=? AND expires_at>=?",
+		nonce, timestamp())
+	if err != nil {
+		return nil, nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil, ErrInvalidItoken
+	}
+	return p, id, nil
+}
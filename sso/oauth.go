@@ -0,0 +1,272 @@
+package sso
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OAuthStateLifetime is the number of seconds the user has to complete the
+// authorization code flow once it's started.
+var OAuthStateLifetime int64 = 600
+
+// OAuthStateCookie is the name of the cookie that ties an authorization code
+// flow to the browser that started it.
+const OAuthStateCookie = "oauth_state"
+
+// Type OAuthConfig describes how to run the OAuth2 authorization code flow
+// with a provider.
+type OAuthConfig struct {
+	AuthURL      string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// TokenField is the field of the token endpoint's response that holds the
+	// token to pass to the provider's Verify, usually "id_token".
+	TokenField string
+
+	// Client is used to call the token endpoint.  If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Type CodeFlowProvider is a Provider that fsso can sign in with by driving
+// the OAuth2 authorization code flow itself.
+type CodeFlowProvider interface {
+	Provider
+	OAuth() (*OAuthConfig, error)
+}
+
+// StartOAuth begins the authorization code flow with the named provider.
+// It returns the URL to redirect the user to, and a cookie to set on the way
+// there.  The cookie holds the state, so that FinishOAuth only accepts the
+// callback from the same browser; otherwise someone could start a flow and
+// trick another user into finishing it, signing them in as the wrong member.
+//
+// redirectURI is where the provider should send the user back to, and must
+// be registered with the provider.  returnTo is where the user should end
+// up once signed in; it must be a path on this site.
+func StartOAuth(provider, redirectURI, returnTo string) (string, *http.Cookie, error) {
+
+	p, ok := GetProvider(provider).(CodeFlowProvider)
+	if !ok {
+		return "", nil, ErrUnknownProvider
+	}
+	c, err := p.OAuth()
+	if err != nil {
+		return "", nil, err
+	}
+	callback, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", nil, err
+	}
+
+	returnTo = localPath(returnTo)
+
+	// The verifier is for PKCE.  We only need a nonce when we'll be getting an
+	// ID token back.
+	verifier := RandomToken(64)
+	nonce := ""
+	if c.TokenField == "id_token" {
+		nonce = RandomToken(32)
+	}
+	expiry := timestamp() + OAuthStateLifetime
+
+	var state string
+	for {
+		state = RandomToken(32)
+		if _, err := db.Exec(
+			"INSERT INTO "+oauthStateTable+" (state, provider, verifier, nonce, redirect_uri, return_to, expires_at) VALUES (?,?,?,?,?,?,?)",
+			state, provider, verifier, nonce, redirectURI, returnTo, expiry); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return "", nil, err
+		}
+		break
+	}
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(c.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if nonce != "" {
+		q.Set("nonce", nonce)
+	}
+
+	return addQuery(c.AuthURL, q), stateCookie(callback, state, int(OAuthStateLifetime)), nil
+}
+
+// ClearOAuthStateCookie returns a cookie that removes the state cookie set by
+// StartOAuth for the same redirectURI.  The state is only good for one try,
+// so the callback should always clear it.
+func ClearOAuthStateCookie(redirectURI string) *http.Cookie {
+	callback, err := url.Parse(redirectURI)
+	if err != nil {
+		callback = &url.URL{}
+	}
+	return stateCookie(callback, "", -1)
+}
+
+// stateCookie returns the state cookie for a flow whose callback is at
+// callback.  It's scoped to the callback's path, so that it only goes back
+// there.
+func stateCookie(callback *url.URL, state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     OAuthStateCookie,
+		Value:    state,
+		Path:     callback.Path,
+		MaxAge:   maxAge,
+		Secure:   callback.Scheme == "https",
+		HttpOnly: true,
+		// Lax, since the provider sends the browser back with a top-level GET.
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// pkceChallenge returns the S256 code challenge for a PKCE verifier
+// (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// FinishOAuth completes the authorization code flow when the provider sends
+// the user back to us.  It exchanges the code for a token and signs in with
+// it much like SigninSocial.  Returns the path that was passed to StartOAuth
+// as returnTo.  The request must carry the cookie from StartOAuth.
+func FinishOAuth(r *http.Request, provider, state, code string) (*SigninReply, string, error) {
+
+	cookie, err := r.Cookie(OAuthStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return nil, "", ErrInvalidOAuthState
+	}
+
+	var (
+		stateProvider, verifier, nonce, redirectURI, returnTo string
+		expiry                                                int64
+	)
+
+	// The state is single use, so delete it as we read it.
+	err = inTx(func(t *sql.Tx) error {
+		if err := t.QueryRow(
+			"SELECT provider, verifier, nonce, redirect_uri, return_to, expires_at FROM "+oauthStateTable+" WHERE state=? FOR UPDATE",
+			state).Scan(&stateProvider, &verifier, &nonce, &redirectURI, &returnTo, &expiry); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidOAuthState
+			}
+			return err
+		}
+		_, err := t.Exec("DELETE FROM "+oauthStateTable+" WHERE state=?", state)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if stateProvider != provider || expiry < timestamp() {
+		return nil, "", ErrInvalidOAuthState
+	}
+	returnTo = localPath(returnTo)
+
+	p, ok := GetProvider(provider).(CodeFlowProvider)
+	if !ok {
+		return nil, "", ErrUnknownProvider
+	}
+	c, err := p.OAuth()
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := exchangeCode(c, code, redirectURI, verifier)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The nonce was ours from the start and the state it came with is used
+	// up, so it doesn't go through verifySocial.
+	id, err := p.Verify(token)
+	if err != nil {
+		return nil, "", err
+	}
+	if id.Nonce != nonce {
+		return nil, "", ErrInvalidItoken
+	}
+	mid, err := authIdentity(p, id)
+	if err != nil {
+		return nil, "", err
+	}
+	reply, err := startSession(r, mid)
+	if err != nil {
+		return nil, "", err
+	}
+	return reply, returnTo, nil
+}
+
+// localPath returns p if it's a path on this site, and "/" otherwise.
+// Browsers treat a backslash like a slash, so "/\evil.com" would be read as
+// "//evil.com", and control characters may be dropped; we reject both.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") ||
+		strings.ContainsAny(p, "\\\x00\t\r\n") {
+		return "/"
+	}
+	u, err := url.Parse(p)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	return p
+}
+
+// exchangeCode calls the provider's token endpoint to swap an authorization
+// code for a token.
+func exchangeCode(c *OAuthConfig, code, redirectURI, verifier string) (string, error) {
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.PostForm(c.TokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {c.ClientID},
+		"client_secret": {c.ClientSecret},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		// Most likely the code was bad or has already been used.
+		return "", ErrInvalidOAuthState
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("token endpoint %s: %s", c.TokenURL, resp.Status)
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	token, _ := body[c.TokenField].(string)
+	if token == "" {
+		return "", ErrInvalidItoken
+	}
+	return token, nil
+}
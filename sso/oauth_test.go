@@ -0,0 +1,56 @@
+package sso
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+
+	tests := map[string]string{
+		"/":                        "/",
+		"/account":                 "/account",
+		"/account?tab=mfa#top":     "/account?tab=mfa#top",
+		"":                         "/",
+		"account":                  "/",
+		"//evil.example.com":       "/",
+		"//evil.example.com/path":  "/",
+		"/\\evil.example.com":      "/",
+		"\\\\evil.example.com":     "/",
+		"https://evil.example.com": "/",
+		"javascript:alert(1)":      "/",
+		"/\t/evil.example.com":     "/",
+		"/\r\nSet-Cookie: a=b":     "/",
+		"/\x00":                    "/",
+		"/%zz":                     "/",
+	}
+	for in, want := range tests {
+		if got := localPath(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPKCEChallenge(t *testing.T) {
+
+	// The example from RFC 7636, appendix B.
+	got := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestOAuthStateCookie(t *testing.T) {
+
+	redirectURI := "https://example.com/sso/oauth/google/callback"
+	set := stateCookie(&url.URL{Scheme: "https", Path: "/sso/oauth/google/callback"}, "state", 600)
+	clear := ClearOAuthStateCookie(redirectURI)
+
+	// The cookie can only be cleared if it's for the same path.
+	if clear.Name != set.Name || clear.Path != set.Path || clear.Path != "/sso/oauth/google/callback" {
+		t.Errorf("set %+v, cleared %+v", set, clear)
+	}
+	if clear.MaxAge >= 0 || clear.Value != "" || !clear.HttpOnly || !clear.Secure {
+		t.Errorf("cleared %+v", clear)
+	}
+}
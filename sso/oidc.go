@@ -0,0 +1,197 @@
+package sso
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Type oidcConfig holds the parts of an OpenID Connect discovery document
+// that we use.
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// Type OIDCProvider verifies ID tokens from any OpenID Connect identity
+// provider, such as Keycloak.  The provider's endpoints and signing keys are
+// found through OpenID Connect discovery the first time they're needed.
+//
+// Accounts from all OIDCProviders are stored in fsso_auth_oidc, told apart by
+// issuer, so several identity providers can be registered at once.
+type OIDCProvider struct {
+	ClientID     string       // client id of this application at the provider
+	ClientSecret string       // only needed for the authorization code flow
+	Client       *http.Client // used for all requests to the provider
+
+	name   string
+	issuer string
+
+	mu          sync.Mutex
+	config      *oidcConfig
+	keys        KeySource
+	triedAt     int64         // time of the last failed discovery
+	discoverErr error         // why it failed
+	discovering chan struct{} // closed when the discovery under way is done
+}
+
+// oidcRetryInterval is the number of seconds to wait after discovery fails
+// before trying again.  Until then, signins with the provider fail straight
+// away.
+const oidcRetryInterval = 60
+
+// NewOIDCProvider creates a provider that will be registered under name for
+// the identity provider at the issuer URL.
+func NewOIDCProvider(name, issuer, clientID string) *OIDCProvider {
+	return &OIDCProvider{
+		ClientID: clientID,
+		Client:   defaultClient,
+		name:     name,
+		issuer:   strings.TrimSuffix(issuer, "/"),
+	}
+}
+
+// Name implements Provider.
+func (o *OIDCProvider) Name() string {
+	return o.name
+}
+
+// Table implements Provider.
+func (o *OIDCProvider) Table() string {
+	return oidcAuthTable
+}
+
+// Issuer implements ScopedProvider.
+func (o *OIDCProvider) Issuer() string {
+	return o.issuer
+}
+
+// discover fetches the provider's discovery document, if we haven't already.
+// Only one request fetches it, without holding the lock; any others wait for
+// it.  After a failure, we don't try again for oidcRetryInterval seconds.
+func (o *OIDCProvider) discover() (*oidcConfig, KeySource, error) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for o.config == nil && o.discovering != nil {
+		done := o.discovering
+		o.mu.Unlock()
+		<-done
+		o.mu.Lock()
+	}
+	if o.config != nil {
+		return o.config, o.keys, nil
+	}
+	if o.discoverErr != nil && timestamp()-o.triedAt < oidcRetryInterval {
+		return nil, nil, o.discoverErr
+	}
+
+	done := make(chan struct{})
+	o.discovering = done
+	o.mu.Unlock()
+	c, err := o.fetchConfig()
+	o.mu.Lock()
+	o.discovering = nil
+	close(done)
+
+	if err != nil {
+		o.triedAt, o.discoverErr = timestamp(), err
+		return nil, nil, err
+	}
+	o.config = c
+	o.keys = NewJWKSCache(URLJWKS(o.Client, c.JwksURI))
+	return o.config, o.keys, nil
+}
+
+// fetchConfig fetches and checks the provider's discovery document.
+func (o *OIDCProvider) fetchConfig() (*oidcConfig, error) {
+
+	u := o.issuer + "/.well-known/openid-configuration"
+	resp, err := o.Client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+
+	var c oidcConfig
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(c.Issuer, "/") != o.issuer || c.JwksURI == "" {
+		return nil, fmt.Errorf("%s: bad discovery document", u)
+	}
+	return &c, nil
+}
+
+// OAuth implements CodeFlowProvider.
+func (o *OIDCProvider) OAuth() (*OAuthConfig, error) {
+	config, _, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	return &OAuthConfig{
+		AuthURL:      config.AuthorizationEndpoint,
+		TokenURL:     config.TokenEndpoint,
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+		TokenField:   "id_token",
+		Client:       o.Client,
+	}, nil
+}
+
+// NonceClaim implements NonceProvider.
+func (o *OIDCProvider) NonceClaim() {}
+
+// Verify implements Provider.
+func (o *OIDCProvider) Verify(idToken string) (*Identity, error) {
+
+	config, keys, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	var c idClaims
+	if err := verifyJWT(idToken, keys, &c); err != nil {
+		return nil, err
+	}
+
+	if c.Iss != config.Issuer {
+		return nil, ErrInvalidItoken
+	}
+	if !c.Aud.Contains(o.ClientID) {
+		return nil, ErrInvalidItoken
+	}
+	// If the token is meant for more than one party, then it must say that it
+	// was issued to us.
+	if (len(c.Aud) > 1 || c.Azp != "") && c.Azp != o.ClientID {
+		return nil, ErrInvalidItoken
+	}
+	if c.Exp+clockSkew < timestamp() {
+		return nil, ErrInvalidItoken
+	}
+	if c.Sub == "" {
+		return nil, ErrInvalidItoken
+	}
+
+	// Only pass on the email address if the provider vouches for it.
+	id := &Identity{
+		Uid:       c.Sub,
+		FullName:  c.Name,
+		ShortName: c.GivenName,
+		Nonce:     c.Nonce,
+	}
+	if c.EmailVerified {
+		id.Email = c.Email
+	}
+	return id, nil
+}
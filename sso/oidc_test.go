@@ -0,0 +1,104 @@
+package sso
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// discoveryServer serves a discovery document, as made by doc from the
+// server's own URL, and counts how often it's asked for it.
+func discoveryServer(t *testing.T, doc func(issuer string) interface{}) (*httptest.Server, *int32) {
+	t.Helper()
+	var hits int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		d := doc(srv.URL)
+		if d == nil {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+
+	srv, hits := discoveryServer(t, func(issuer string) interface{} {
+		return oidcConfig{
+			Issuer:                issuer + "/",
+			AuthorizationEndpoint: issuer + "/auth",
+			TokenEndpoint:         issuer + "/token",
+			JwksURI:               issuer + "/jwks",
+		}
+	})
+
+	// A trailing slash on the issuer doesn't matter.
+	o := NewOIDCProvider("test", srv.URL+"/", testClientID)
+	o.Client = srv.Client()
+
+	c, err := o.OAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthURL != srv.URL+"/auth" || c.TokenURL != srv.URL+"/token" || c.ClientID != testClientID || c.Client != srv.Client() {
+		t.Errorf("got %+v", c)
+	}
+	if o.Issuer() != srv.URL {
+		t.Errorf("issuer: got %s", o.Issuer())
+	}
+
+	// The document is only fetched once.
+	if _, err := o.OAuth(); err != nil || atomic.LoadInt32(hits) != 1 {
+		t.Errorf("again: %d hits, %v", atomic.LoadInt32(hits), err)
+	}
+}
+
+func TestOIDCDiscoveryBad(t *testing.T) {
+
+	tests := map[string]func(issuer string) interface{}{
+		"server error": func(string) interface{} { return nil },
+		"other issuer": func(issuer string) interface{} {
+			return oidcConfig{Issuer: "https://evil.example.com", JwksURI: issuer + "/jwks"}
+		},
+		"no jwks_uri": func(issuer string) interface{} { return oidcConfig{Issuer: issuer} },
+		"not json":    func(string) interface{} { return "not a document" },
+	}
+	for name, doc := range tests {
+		srv, hits := discoveryServer(t, doc)
+		o := NewOIDCProvider("test", srv.URL, testClientID)
+		o.Client = srv.Client()
+
+		if _, err := o.Verify("token"); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+		// Signins fail straight away for a while, rather than each trying
+		// again.
+		if _, err := o.OAuth(); err == nil || atomic.LoadInt32(hits) != 1 {
+			t.Errorf("%s: again: %d hits, %v", name, atomic.LoadInt32(hits), err)
+		}
+	}
+}
+
+func TestOIDCDiscoveryUnreachable(t *testing.T) {
+
+	srv, _ := discoveryServer(t, func(string) interface{} { return nil })
+	srv.Close()
+
+	o := NewOIDCProvider("test", srv.URL, testClientID)
+	if _, err := o.OAuth(); err == nil {
+		t.Error("no error")
+	}
+	if o.Client != defaultClient || defaultClient.Timeout == 0 {
+		t.Error("client has no timeout")
+	}
+}
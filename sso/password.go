@@ -0,0 +1,225 @@
+package sso
+
+import (
+	"database/sql"
+	"log"
+	"net/url"
+)
+
+// Password reset settings.  ResetURL is the page that reset links go to, with
+// the token as a ptoken parameter.  ResetLifetime is in seconds.
+var (
+	ResetURL            = "http://localhost:8000/reset"
+	ResetLifetime int64 = 3600
+)
+
+// RequestPasswordReset emails a link for resetting the password to the
+// address given, in the language given by lang, if a member signs in with
+// that address.
+//
+// So as not to give away which addresses are registered, the work happens in
+// the background and RequestPasswordReset always returns right away.
+func RequestPasswordReset(email, lang string) {
+	go func() {
+		if err := sendResetLink(email, lang); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// sendResetLink does the work for RequestPasswordReset.
+func sendResetLink(email, lang string) error {
+
+	var mid int64
+	if err := db.QueryRow(
+		"SELECT member_id FROM "+emailAuthTable+" WHERE email=?",
+		email).Scan(&mid); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	m, err := getMember(mid)
+	if err == ErrDisabledAccount {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	expiry := timestamp() + ResetLifetime
+	for {
+		ptoken := RandomToken(32)
+		if _, err := db.Exec(
+			"INSERT INTO "+passwordResetTable+" (ptoken, member_id, email, expires_at) VALUES (?,?,?,?)",
+			ptoken, mid, email, expiry); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return err
+		}
+		return sendMail(lang, "reset", email, &mailData{
+			Name:  m.ShortName,
+			Email: email,
+			Link:  addQuery(ResetURL, url.Values{"ptoken": {ptoken}}),
+		})
+	}
+}
+
+// ResetPassword sets a new password using a token from a reset link.  Tokens
+// may only be used once.  Since the old password may have been compromised,
+// the member is signed out everywhere.
+func ResetPassword(ptoken, password, lang string) error {
+
+	var (
+		mid, expiry int64
+		email       string
+	)
+
+	err := inTx(func(t *sql.Tx) error {
+
+		if err := t.QueryRow(
+			"SELECT member_id, email, expires_at FROM "+passwordResetTable+" WHERE ptoken=? FOR UPDATE",
+			ptoken).Scan(&mid, &email, &expiry); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidResetToken
+			}
+			return err
+		}
+		if expiry < timestamp() {
+			return ErrInvalidResetToken
+		}
+
+		m, err := getMember(mid)
+		if err != nil {
+			return err
+		}
+		if err := PasswordRules.Check(password, email, m.FullName, m.ShortName); err != nil {
+			return err
+		}
+		pwhash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		// The member may have other reset links outstanding; they're no good now.
+		if _, err := t.Exec(
+			"DELETE FROM "+passwordResetTable+" WHERE member_id=?",
+			mid); err != nil {
+			return err
+		}
+
+		res, err := t.Exec(
+			"UPDATE "+emailAuthTable+" SET pwhash=?, pwchanged_at=? WHERE member_id=? AND email=?",
+			pwhash, timestamp(), mid, email)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// The email address was changed after the link was sent.
+			return ErrInvalidResetToken
+		}
+
+		return revokeMember(t, mid)
+	})
+	if err != nil {
+		return err
+	}
+
+	notifyPasswordChanged(mid, email, lang)
+	return nil
+}
+
+// ChangePassword changes the member's password, after checking that the
+// current password is right.  If signoutOthers is true, all of the member's
+// other sessions are ended, along with their refresh token and access tokens
+// issued to other applications, so this session will need to sign in again
+// once it ends.
+func (m *Member) ChangePassword(current, password string, signoutOthers bool, lang string) error {
+
+	var email, pwhash string
+	if err := db.QueryRow(
+		"SELECT email, pwhash FROM "+emailAuthTable+" WHERE member_id=?",
+		m.id).Scan(&email, &pwhash); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNoEmail
+		}
+		return err
+	}
+
+	if err := reauthenticate(email, pwhash, current); err != nil {
+		return err
+	}
+	if password == current {
+		return ErrNoChange
+	}
+	if err := PasswordRules.Check(password, email, m.FullName, m.ShortName); err != nil {
+		return err
+	}
+
+	pwhash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = inTx(func(t *sql.Tx) error {
+		if _, err := t.Exec(
+			"UPDATE "+emailAuthTable+" SET pwhash=?, pwchanged_at=? WHERE member_id=?",
+			pwhash, timestamp(), m.id); err != nil {
+			return err
+		}
+		if !signoutOthers {
+			return nil
+		}
+		return revokeOthers(t, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	notifyPasswordChanged(m.id, email, lang)
+	return nil
+}
+
+// reauthenticate checks the password of a member who is already signed in,
+// before something that needs them to prove it's really them.  Wrong
+// passwords count against the account in Lockout, as they do for signing in,
+// so that a stolen session can't be used to guess the password.
+func reauthenticate(email, pwhash, password string) error {
+
+	if Lockout != nil {
+		if err := Lockout.check(accountKey(email)); err != nil {
+			return err
+		}
+	}
+
+	ok, _, err := verifyPassword(pwhash, password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if Lockout != nil {
+			Lockout.failKey(accountKey(email), Lockout.AccountAttempts)
+		}
+		return ErrReauthenticationFailure
+	}
+	if Lockout != nil {
+		Lockout.succeed(email)
+	}
+	return nil
+}
+
+// notifyPasswordChanged lets the member know, in the background, that their
+// password has been changed.
+func notifyPasswordChanged(mid int64, email, lang string) {
+	go func() {
+		m, err := getMember(mid)
+		if err == nil {
+			err = sendMail(lang, "password-changed", email, &mailData{Name: m.ShortName, Email: email})
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+}
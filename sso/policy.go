@@ -0,0 +1,184 @@
+package sso
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Reasons a password may be rejected, as reported in PasswordError.
+const (
+	ReasonTooShort = "short"    // fewer than MinLength characters
+	ReasonTooLong  = "long"     // more than MaxLength characters or MaxBytes bytes
+	ReasonLower    = "lower"    // no lowercase letter
+	ReasonUpper    = "upper"    // no uppercase letter
+	ReasonDigit    = "digit"    // no digit
+	ReasonSymbol   = "symbol"   // no character that isn't a letter or digit
+	ReasonPersonal = "personal" // contains the member's email address or name
+	ReasonBreached = "breached" // appears in a list of leaked passwords
+)
+
+// Type PasswordError is returned when a password doesn't satisfy the password
+// policy.  Reasons lists everything that's wrong with it.
+type PasswordError struct {
+	Reasons []string
+}
+
+func (e *PasswordError) Error() string {
+	return ErrBadPassword.Message
+}
+
+// Type PasswordPolicy is the set of rules that new passwords must follow.
+// Lengths are counted in characters, except for MaxBytes.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int // 0 for no limit
+
+	// MaxBytes should be no more than 72 while passwords are hashed with
+	// BcryptHasher, which ignores anything past the 72nd byte.
+	MaxBytes int
+
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+
+	// ForbidPersonal disallows passwords that contain the member's email
+	// address (the part before the @) or any part of their name.
+	ForbidPersonal bool
+
+	// Breached, if not nil, is checked for passwords known to be leaked.
+	Breached BreachedList
+}
+
+// PasswordRules is the policy that all new passwords are checked against.
+var PasswordRules = &PasswordPolicy{
+	MinLength:      8,
+	MaxBytes:       72,
+	ForbidPersonal: true,
+}
+
+// Check returns a *PasswordError if pw breaks any of the rules.  personal is
+// the member's email address and names, for ForbidPersonal.
+func (p *PasswordPolicy) Check(pw string, personal ...string) error {
+
+	var reasons []string
+	n := utf8.RuneCountInString(pw)
+
+	if n < p.MinLength {
+		reasons = append(reasons, ReasonTooShort)
+	}
+	if (p.MaxLength > 0 && n > p.MaxLength) || (p.MaxBytes > 0 && len(pw) > p.MaxBytes) {
+		reasons = append(reasons, ReasonTooLong)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range pw {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		case !unicode.IsLetter(c):
+			symbol = true
+		}
+	}
+	if p.RequireLower && !lower {
+		reasons = append(reasons, ReasonLower)
+	}
+	if p.RequireUpper && !upper {
+		reasons = append(reasons, ReasonUpper)
+	}
+	if p.RequireDigit && !digit {
+		reasons = append(reasons, ReasonDigit)
+	}
+	if p.RequireSymbol && !symbol {
+		reasons = append(reasons, ReasonSymbol)
+	}
+
+	if p.ForbidPersonal && containsPersonal(pw, personal) {
+		reasons = append(reasons, ReasonPersonal)
+	}
+
+	// Only bother with the breached list if the password is otherwise good.
+	if len(reasons) == 0 && p.Breached != nil {
+		breached, err := p.Breached.Contains(pw)
+		if err != nil {
+			return err
+		}
+		if breached {
+			reasons = append(reasons, ReasonBreached)
+		}
+	}
+
+	if len(reasons) > 0 {
+		return &PasswordError{reasons}
+	}
+	return nil
+}
+
+// containsPersonal returns true if pw contains, ignoring case, the local part
+// of an email address or any word of a name in personal.  Very short words
+// are skipped.
+func containsPersonal(pw string, personal []string) bool {
+	pw = strings.ToLower(pw)
+	for _, s := range personal {
+		if i := strings.IndexByte(s, '@'); i >= 0 {
+			s = s[:i]
+		}
+		for _, w := range strings.Fields(strings.ToLower(s)) {
+			if utf8.RuneCountInString(w) >= 3 && strings.Contains(pw, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Type BreachedList tells whether a password is known to have been leaked.
+type BreachedList interface {
+	Contains(pw string) (bool, error)
+}
+
+// Type BreachedDir is a BreachedList kept on local disk the same way the
+// Pwned Passwords range API serves it.  The directory has one file for each
+// five-digit prefix of the uppercase hex SHA-1 hashes of leaked passwords,
+// named by that prefix.  Each file lists the remaining 35 digits of each hash
+// with that prefix, one per line, optionally followed by :count.
+type BreachedDir string
+
+// Contains implements BreachedList.
+func (d BreachedDir) Contains(pw string) (bool, error) {
+
+	sum := sha1.Sum([]byte(pw))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	f, err := os.Open(filepath.Join(string(d), hash[:5]))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	suffix := hash[5:]
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(strings.TrimSpace(line), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
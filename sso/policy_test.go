@@ -0,0 +1,115 @@
+package sso
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// reasons returns the reasons that p rejects pw for, or nil if it doesn't.
+func reasons(t *testing.T, p *PasswordPolicy, pw string, personal ...string) []string {
+	t.Helper()
+	err := p.Check(pw, personal...)
+	if err == nil {
+		return nil
+	}
+	perr, ok := err.(*PasswordError)
+	if !ok {
+		t.Fatalf("%q: %v", pw, err)
+	}
+	return perr.Reasons
+}
+
+func TestPasswordRules(t *testing.T) {
+
+	all := &PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      16,
+		MaxBytes:       20,
+		RequireLower:   true,
+		RequireUpper:   true,
+		RequireDigit:   true,
+		RequireSymbol:  true,
+		ForbidPersonal: true,
+	}
+	personal := []string{"ada.lovelace@example.com", "Augusta Ada Byron", "Al"}
+
+	tests := []struct {
+		pw   string
+		want []string
+	}{
+		{"Abcdef1!", nil},
+		{"Abcde1!", []string{ReasonTooShort}},
+		{"Abcdefghijklm1!x", nil},
+		{"Abcdefghijklm1!xy", []string{ReasonTooLong}},
+		// Lengths are in characters, but MaxBytes counts bytes.
+		{"Äbcdéf1!", nil},
+		{"Ääääääääää1!", []string{ReasonTooLong}},
+		{"ABCDEF1!", []string{ReasonLower}},
+		{"abcdef1!", []string{ReasonUpper}},
+		{"Abcdefg!", []string{ReasonDigit}},
+		{"Abcdefg1", []string{ReasonSymbol}},
+		{"Byron-99x", []string{ReasonPersonal}},
+		{"xAda.Lovelace1!", []string{ReasonPersonal}},
+		// Words shorter than three characters don't count.
+		{"Xal1!xyzw", nil},
+		{"abc", []string{ReasonTooShort, ReasonUpper, ReasonDigit, ReasonSymbol}},
+	}
+	for _, test := range tests {
+		if got := reasons(t, all, test.pw, personal...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.pw, got, test.want)
+		}
+	}
+
+	// The default policy only cares about length and personal details.
+	for pw, want := range map[string][]string{
+		"1234567":               {ReasonTooShort},
+		"12345678":              nil,
+		strings.Repeat("a", 72): nil,
+		strings.Repeat("a", 73): {ReasonTooLong},
+		"ada.lovelace":          {ReasonPersonal},
+	} {
+		if got := reasons(t, PasswordRules, pw, personal...); !reflect.DeepEqual(got, want) {
+			t.Errorf("default %q: got %v, want %v", pw, got, want)
+		}
+	}
+}
+
+func TestBreachedDir(t *testing.T) {
+
+	// sha1("password") is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8.
+	dir := t.TempDir()
+	list := "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n" +
+		"1e4c9b93f3f0682250b6cf8331b7ee68fd8:3730471\r\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "5BAA6"), []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &PasswordPolicy{MinLength: 8, Breached: BreachedDir(dir)}
+
+	if got := reasons(t, p, "password"); !reflect.DeepEqual(got, []string{ReasonBreached}) {
+		t.Errorf("breached: got %v", got)
+	}
+	// Same prefix file, different hash; and no file for the prefix at all.
+	for _, pw := range []string{"correct horse battery staple", "passwore"} {
+		if got := reasons(t, p, pw); got != nil {
+			t.Errorf("%q: got %v", pw, got)
+		}
+	}
+
+	// The list isn't consulted for passwords that fail anyway.
+	p.Breached = failingList{}
+	if got := reasons(t, p, "short"); !reflect.DeepEqual(got, []string{ReasonTooShort}) {
+		t.Errorf("short: got %v", got)
+	}
+	if err := p.Check("long enough"); err == nil {
+		t.Error("list error: no error")
+	}
+}
+
+// Type failingList is a BreachedList that can't be read.
+type failingList struct{}
+
+func (failingList) Contains(string) (bool, error) { return false, errors.New("unreadable") }
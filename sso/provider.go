@@ -0,0 +1,82 @@
+package sso
+
+import (
+	"sort"
+	"sync"
+)
+
+// Type Identity is what a provider tells us about the owner of a verified
+// token.
+type Identity struct {
+	Uid       string // unique and permanent id of the account at the provider
+	Email     string // verified email address, or "" if there isn't one
+	FullName  string
+	ShortName string
+	Nonce     string // nonce claim of an OpenID Connect ID token, if any
+}
+
+// Type Provider verifies the tokens issued by a social network or other
+// identity provider.  Register a Provider with RegisterProvider to make it
+// available to SigninSocial and ConnectSocial.
+type Provider interface {
+
+	// Name is how callers refer to the provider, e.g. "google".
+	Name() string
+
+	// Verify validates a token and returns the identity it asserts.  Verify
+	// should return ErrInvalidItoken if the token is not acceptable.
+	Verify(token string) (*Identity, error)
+
+	// Table is the auth table where accounts from this provider are stored.
+	// It must have the same columns as fsso_auth_goog; see mysql/schema.sql.
+	Table() string
+}
+
+// Type ScopedProvider is a Provider that shares its auth table with other
+// providers.  The table has an extra issuer column to tell their accounts
+// apart; see fsso_auth_oidc in mysql/schema.sql.
+type ScopedProvider interface {
+	Provider
+	Issuer() string
+}
+
+// Type NonceProvider is a Provider whose tokens carry a nonce, as OpenID
+// Connect ID tokens do.  Tokens from these providers are only accepted with
+// a nonce from NewNonce.  NonceClaim does nothing; it just marks the type.
+type NonceProvider interface {
+	Provider
+	NonceClaim()
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]Provider)
+)
+
+// RegisterProvider makes a provider available under its name, replacing any
+// provider already registered with that name.
+func RegisterProvider(p Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[p.Name()] = p
+}
+
+// GetProvider returns the provider registered with the given name, or nil if
+// there is none.
+func GetProvider(name string) Provider {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	return providers[name]
+}
+
+// Providers returns all registered providers, sorted by name.
+func Providers() []Provider {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	list := make([]Provider, 0, len(providers))
+	for _, p := range providers {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
@@ -0,0 +1,97 @@
+package sso
+
+import "database/sql"
+
+// ReauthLifetime is the number of seconds after signing in or
+// reauthenticating that the member may change how they sign in (see
+// requireRecentAuth).
+var ReauthLifetime int64 = 5 * 60
+
+// ReauthPassword has the member confirm it's them with their password, so
+// that their current session may change how they sign in for the next
+// ReauthLifetime seconds.
+func (m *Member) ReauthPassword(password string) error {
+	if err := m.checkPassword(password); err != nil {
+		return err
+	}
+	return m.markReauth()
+}
+
+// ReauthSocial is like ReauthPassword, for members who reauthenticate with a
+// fresh id token from one of their social network accounts.  See AuthSocial
+// regarding the nonce.
+func (m *Member) ReauthSocial(provider, idToken, nonce string) error {
+	if err := m.checkSocial(provider, idToken, nonce); err != nil {
+		return err
+	}
+	return m.markReauth()
+}
+
+// checkPassword checks the member's password.  Wrong ones count against
+// them in Lockout.
+func (m *Member) checkPassword(password string) error {
+
+	var email, pwhash string
+	if err := db.QueryRow(
+		"SELECT email, pwhash FROM "+emailAuthTable+" WHERE member_id=?",
+		m.id).Scan(&email, &pwhash); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNoEmail
+		}
+		return err
+	}
+	return reauthenticate(email, pwhash, password)
+}
+
+// checkSocial checks that an id token is for one of the member's social
+// network accounts.
+func (m *Member) checkSocial(provider, idToken, nonce string) error {
+
+	p, id, err := verifySocial(provider, idToken, nonce)
+	if err != nil {
+		return err
+	}
+	mid, err := tableFor(p).find(id.Uid)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if mid != m.id {
+		return ErrReauthenticationFailure
+	}
+	return nil
+}
+
+// markReauth records that the member has just reauthenticated in their
+// current session.
+func (m *Member) markReauth() error {
+	now := timestamp()
+	if _, err := db.Exec(
+		"UPDATE "+activeTable+" SET reauth_at=? WHERE atoken=?",
+		now, m.aToken); err != nil {
+		return err
+	}
+	m.reauthAt = now
+	return nil
+}
+
+// requireRecentAuth guards changes to how the member signs in, so that
+// someone who gets hold of a session can't use it to take over the account
+// for good.  The member must have signed in or reauthenticated within the
+// last ReauthLifetime seconds, and if they have two-factor authentication,
+// the session must have passed it.
+func (m *Member) requireRecentAuth() error {
+
+	if !m.mfa {
+		methods, err := mfaMethods(m.id)
+		if err != nil {
+			return err
+		}
+		if len(methods) > 0 {
+			return ErrMfaRequired
+		}
+	}
+	if m.reauthAt+ReauthLifetime < timestamp() {
+		return ErrReauthRequired
+	}
+	return nil
+}
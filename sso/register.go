@@ -0,0 +1,101 @@
+package sso
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RequestVcode starts signup for a new member by emailing a link with a verify
+// code to their address, in the language given by lang.  If the address is
+// already registered, the member gets an email saying so instead.
+//
+// As with RequestPasswordReset, so as not to give away which addresses are
+// registered, the work happens in the background.  Only an address that
+// isn't plausible gets an error.
+func RequestVcode(email, lang string) error {
+
+	if !plausibleEmail(email) {
+		return ErrInvalidEmail
+	}
+	go func() {
+		if err := sendVcode(email, lang); err != nil {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// sendVcode does the work for RequestVcode.
+func sendVcode(email, lang string) error {
+
+	var mid int64
+	err := db.QueryRow(
+		"SELECT member_id FROM "+emailAuthTable+" WHERE email=?",
+		email).Scan(&mid)
+	if err == nil {
+		m, err := getMember(mid)
+		if err == ErrDisabledAccount {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return sendMail(lang, "registered", email, &mailData{
+			Name:  m.ShortName,
+			Email: email,
+		})
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	vcode, err := GenerateVcode(email)
+	if err != nil {
+		return err
+	}
+	return sendMail(lang, "verify", email, &mailData{
+		Email: email,
+		Link:  addQuery(VerifyURL, url.Values{"vcode": {vcode}}),
+	})
+}
+
+// Register creates a new member with email/password signin, using a verify
+// code to prove ownership of the email address, and signs them in with a
+// session cookie.
+func Register(r *http.Request, vcode, password, fullname, shortname string) (*SigninReply, error) {
+
+	email, err := GetVerifiedEmail(vcode)
+	if err != nil {
+		return nil, err
+	}
+
+	fullname = strings.TrimSpace(fullname)
+	shortname = strings.TrimSpace(shortname)
+	if fullname == "" || shortname == "" {
+		return nil, ErrMemberDetails
+	}
+	if err := PasswordRules.Check(password, email, fullname, shortname); err != nil {
+		return nil, err
+	}
+
+	var mid int64
+	err = inTx(func(t *sql.Tx) (err error) {
+		if mid, err = createMember(t, email, fullname, shortname); err != nil {
+			return err
+		}
+		if err := addEmailAuth(t, email, password, mid, true); err != nil {
+			return err
+		}
+		// The address is verified now; any other codes for it are no use.
+		_, err = t.Exec("DELETE FROM "+emailVerifyTable+" WHERE email=? AND purpose=?", email, purposeRegister)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return startSession(r, mid)
+}
@@ -0,0 +1,217 @@
+package sso
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// SessionCookie is the name of the cookie that carries the atoken for
+// cookie-based sessions.
+const SessionCookie = "sess"
+
+// RefreshLifetime is the number of seconds a refresh token remains valid.
+var RefreshLifetime int64 = 30 * 86400
+
+// Type SessionTimeouts limits how long sessions last.  Idle is the number of
+// seconds a session may go unused, and Lifetime the number of seconds it may
+// last in all.  0 means no limit.
+type SessionTimeouts struct {
+	Idle     int64
+	Lifetime int64
+}
+
+// Session timeouts for cookie sessions and for token-based sessions.  Members
+// with any of AdminRoles have their sessions end after AdminIdleTimeout
+// seconds unused, if that's shorter.  Roles mean whatever the application
+// makes them mean, so AdminRoles is 0 until the application says which
+// roles need the shorter timeout.
+var (
+	CookieTimeouts          = SessionTimeouts{Idle: 30 * 86400}
+	TokenTimeouts           = SessionTimeouts{Idle: 30 * 86400}
+	AdminRoles       uint32 = 0
+	AdminIdleTimeout int64  = 30 * 60
+)
+
+// timeoutsFor returns the timeouts for a session, given whether it's a cookie
+// session and the member's roles.
+func timeoutsFor(isSession bool, roles uint32) SessionTimeouts {
+	t := TokenTimeouts
+	if isSession {
+		t = CookieTimeouts
+	}
+	if roles&AdminRoles != 0 && AdminIdleTimeout > 0 && (t.Idle == 0 || AdminIdleTimeout < t.Idle) {
+		t.Idle = AdminIdleTimeout
+	}
+	return t
+}
+
+// expired tells whether a session created at createdAt and last used at
+// activeAt has timed out by now.
+func (t SessionTimeouts) expired(createdAt, activeAt, now int64) bool {
+	return t.Idle > 0 && activeAt+t.Idle < now ||
+		t.Lifetime > 0 && createdAt+t.Lifetime < now
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// newActive inserts a row into the active table for the member and returns
+// the atoken that identifies it.  isSession is true for cookie-based sessions
+// and false for Authorization header tokens.  The session inherits m.mfa and
+// m.signinAt, which must be set; signing in counts as reauthenticating (see
+// ReauthPassword), so a refreshed session only has the original signin to go
+// by.  Signing in cancels any pending deletion of the member's account.
+func newActive(ex execer, r *http.Request, m *Member, isSession bool) (string, error) {
+
+	if err := cancelDeletion(ex, m.id); err != nil {
+		return "", err
+	}
+
+	useragent := r.UserAgent()
+	if len(useragent) > 50 {
+		useragent = useragent[:50]
+	}
+
+	for {
+		atoken := RandomToken(32)
+		if _, err := ex.Exec(
+			"INSERT INTO "+activeTable+" (atoken, member_id, created_at, active_at, reauth_at, useragent, ip, is_session, is_mfa, data) VALUES (?,?,?,?,?,?,?,?,?,?)",
+			atoken, m.id, m.signinAt, timestamp(), m.signinAt, useragent, r.RemoteAddr, isSession, m.mfa, ""); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return "", err
+		}
+		return atoken, nil
+	}
+}
+
+// newRefresh issues a new refresh token for the member, replacing any that
+// the member already has.  Returns the token and its expiry time.  Sessions
+// refreshed with the token inherit m.mfa and m.signinAt.
+//
+// The token expires no later than the cookie session it comes with could
+// last, going by CookieTimeouts and the member's roles.  Otherwise it would
+// let the member carry on after their session had timed out.
+func newRefresh(ex execer, m *Member) (string, int64, error) {
+
+	if _, err := ex.Exec(
+		"DELETE FROM "+refreshTable+" WHERE member_id=?",
+		m.id); err != nil {
+		return "", 0, err
+	}
+
+	now := timestamp()
+	expiry := now + RefreshLifetime
+	t := timeoutsFor(true, m.roles)
+	if t.Idle > 0 && now+t.Idle < expiry {
+		expiry = now + t.Idle
+	}
+	if t.Lifetime > 0 && m.signinAt+t.Lifetime < expiry {
+		expiry = m.signinAt + t.Lifetime
+	}
+
+	for {
+		rtoken := RandomToken(32)
+		if _, err := ex.Exec(
+			"INSERT INTO "+refreshTable+" (rtoken, member_id, is_mfa, signin_at, expires_at) VALUES (?,?,?,?,?)",
+			rtoken, m.id, m.mfa, m.signinAt, expiry); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return "", 0, err
+		}
+		return rtoken, expiry, nil
+	}
+}
+
+// revokeMember signs the member out everywhere by deleting all of their
+// active sessions, the access tokens we've issued to other applications for
+// them, and their refresh token.
+func revokeMember(ex execer, mid int64) error {
+	if _, err := ex.Exec(
+		"DELETE FROM "+activeTable+" WHERE member_id=?",
+		mid); err != nil {
+		return err
+	}
+	if _, err := ex.Exec(
+		"DELETE FROM "+oidcTokenTable+" WHERE member_id=?",
+		mid); err != nil {
+		return err
+	}
+	_, err := ex.Exec(
+		"DELETE FROM "+refreshTable+" WHERE member_id=?",
+		mid)
+	return err
+}
+
+// startSession signs in an already-authenticated member with a new cookie
+// session and a fresh refresh token.  If the member has two-factor
+// authentication, the reply instead has a challenge token for SigninMFA.
+func startSession(r *http.Request, mid int64) (*SigninReply, error) {
+
+	m, err := getMember(mid)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newChallenge(mid, true)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		return &SigninReply{Mtoken: c.mtoken, MtokenExpires: c.expiry, MfaMethods: c.methods}, nil
+	}
+	return openSession(r, m)
+}
+
+// openSession gives a member who has been fully authenticated a new cookie
+// session and a fresh refresh token.
+func openSession(r *http.Request, m *Member) (*SigninReply, error) {
+
+	var reply *SigninReply
+	err := inTx(func(t *sql.Tx) (err error) {
+		reply, err = issueSession(t, r, m)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// issueSession creates the active row and refresh token for a new cookie
+// session as part of the transaction t.  m.signinAt is when the member
+// signed in, or 0 if they just have.
+func issueSession(t *sql.Tx, r *http.Request, m *Member) (*SigninReply, error) {
+
+	if m.signinAt == 0 {
+		m.signinAt = timestamp()
+	}
+
+	atoken, err := newActive(t, r, m, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rtoken, expiry, err := newRefresh(t, m)
+	if err != nil {
+		return nil, err
+	}
+
+	m.aToken = atoken
+	return &SigninReply{
+		Rtoken:        rtoken,
+		RtokenExpires: expiry,
+		Member:        m,
+		cookie: &http.Cookie{
+			Name:     SessionCookie,
+			Value:    atoken,
+			Path:     "/",
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+		},
+	}, nil
+}
@@ -0,0 +1,151 @@
+package sso
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// Type Session describes one of the places a member is signed in.  ID
+// identifies the session without giving away its atoken, so it's safe to
+// show and to pass to RevokeSession.
+type Session struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"useragent"`
+	IP        string `json:"ip"`
+	ActiveAt  int64  `json:"active_at"`
+	IsCookie  bool   `json:"is_cookie"`
+	IsCurrent bool   `json:"is_current"`
+}
+
+// sessionID derives the public id of a session from its atoken.
+func sessionID(atoken string) string {
+	return hashSecret(atoken)[:16]
+}
+
+// Sessions lists the member's sessions, most recently active first.
+func (m *Member) Sessions() ([]*Session, error) {
+
+	rows, err := db.Query(
+		"SELECT atoken, useragent, ip, active_at, is_session FROM "+activeTable+" WHERE member_id=? ORDER BY active_at DESC",
+		m.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var atoken string
+		s := &Session{}
+		if err := rows.Scan(&atoken, &s.UserAgent, &s.IP, &s.ActiveAt, &s.IsCookie); err != nil {
+			return nil, err
+		}
+		s.ID = sessionID(atoken)
+		s.IsCurrent = atoken == m.aToken
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Signout ends the current session.  If rtoken is given it's revoked too, so
+// that it can't be used to sign in again.
+func (m *Member) Signout(rtoken string) error {
+	return inTx(func(t *sql.Tx) error {
+		if _, err := t.Exec(
+			"DELETE FROM "+activeTable+" WHERE atoken=?",
+			m.aToken); err != nil {
+			return err
+		}
+		if rtoken == "" {
+			return nil
+		}
+		_, err := t.Exec(
+			"DELETE FROM "+refreshTable+" WHERE rtoken=? AND member_id=?",
+			rtoken, m.id)
+		return err
+	})
+}
+
+// RevokeSession ends one of the member's other sessions, given its id from
+// Sessions.  Use Signout to end the current session.  The member's refresh
+// token goes too, since we can't tell which session holds it and it would
+// otherwise let the revoked session straight back in; so this session will
+// need to sign in again once it ends.
+func (m *Member) RevokeSession(id string) error {
+
+	rows, err := db.Query(
+		"SELECT atoken FROM "+activeTable+" WHERE member_id=? AND atoken<>?",
+		m.id, m.aToken)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var atoken string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return err
+		}
+		if sessionID(t) == id {
+			atoken = t
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if atoken == "" {
+		return ErrInvalidSession
+	}
+
+	return inTx(func(t *sql.Tx) error {
+		if _, err := t.Exec(
+			"DELETE FROM "+activeTable+" WHERE atoken=?",
+			atoken); err != nil {
+			return err
+		}
+		_, err := t.Exec(
+			"DELETE FROM "+refreshTable+" WHERE member_id=?",
+			m.id)
+		return err
+	})
+}
+
+// ClearSessions ends all of the member's sessions except the current one,
+// along with their refresh token and the access tokens issued to other
+// applications, so this session will need to sign in again once it ends.
+func (m *Member) ClearSessions() error {
+	return revokeOthers(db, m)
+}
+
+// revokeOthers does the work of ClearSessions as part of ex.
+func revokeOthers(ex execer, m *Member) error {
+	if _, err := ex.Exec(
+		"DELETE FROM "+activeTable+" WHERE member_id=? AND atoken<>?",
+		m.id, m.aToken); err != nil {
+		return err
+	}
+	if _, err := ex.Exec(
+		"DELETE FROM "+oidcTokenTable+" WHERE member_id=?",
+		m.id); err != nil {
+		return err
+	}
+	_, err := ex.Exec(
+		"DELETE FROM "+refreshTable+" WHERE member_id=?",
+		m.id)
+	return err
+}
+
+// SignoutCookie returns a cookie that removes the session cookie from the
+// browser.
+func SignoutCookie(r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+	}
+}
@@ -0,0 +1,123 @@
+package sso
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// Sign-in link settings.  SigninLinkURL is the page that sign-in links go to,
+// with the token as an ltoken parameter.  SigninLinkLifetime is in seconds.
+var (
+	SigninLinkURL            = "http://localhost:8000/signin-link"
+	SigninLinkLifetime int64 = 900
+)
+
+// RequestSigninLink emails a link for signing in without a password to the
+// address given, in the language given by lang, if it's the primary address
+// of a member.
+//
+// As with RequestPasswordReset, the work happens in the background so as not
+// to give away which addresses are registered.
+func RequestSigninLink(email, lang string) {
+	go func() {
+		if err := sendSigninLink(email, lang); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// sendSigninLink does the work for RequestSigninLink.
+func sendSigninLink(email, lang string) error {
+
+	mid, err := memberByEmail(email)
+	if err != nil || mid == 0 {
+		return err
+	}
+	m, err := getMember(mid)
+	if err == ErrDisabledAccount {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ltoken, err := newVerifyToken(email, purposeSignin, SigninLinkLifetime)
+	if err != nil {
+		return err
+	}
+	return sendMail(lang, "signin", email, &mailData{
+		Name:  m.ShortName,
+		Email: email,
+		Link:  addQuery(SigninLinkURL, url.Values{"ltoken": {ltoken}}),
+	})
+}
+
+// SigninLink signs in the member using the token from a sign-in link, just
+// as SigninEmail would with their password.  Links may only be used once.
+func SigninLink(r *http.Request, ltoken string) (*SigninReply, error) {
+
+	var (
+		email  string
+		expiry int64
+	)
+
+	err := inTx(func(t *sql.Tx) error {
+		if err := t.QueryRow(
+			"SELECT email, expires_at FROM "+emailVerifyTable+" WHERE vtoken=? AND purpose=? FOR UPDATE",
+			ltoken, purposeSignin).Scan(&email, &expiry); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidSigninLink
+			}
+			return err
+		}
+		_, err := t.Exec("DELETE FROM "+emailVerifyTable+" WHERE vtoken=?", ltoken)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expiry < timestamp() {
+		return nil, ErrInvalidSigninLink
+	}
+
+	// The primary address may have changed since the link was sent.
+	mid, err := memberByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if mid == 0 {
+		return nil, ErrInvalidSigninLink
+	}
+	return startSession(r, mid)
+}
+
+// memberByEmail returns the id of the member whose primary address is email,
+// or 0 if there isn't exactly one.
+func memberByEmail(email string) (int64, error) {
+
+	rows, err := db.Query(
+		"SELECT id FROM "+memberTable+" WHERE email=? LIMIT 2",
+		email)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) != 1 {
+		return 0, nil
+	}
+	return ids[0], nil
+}
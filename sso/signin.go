@@ -1,26 +1,122 @@
 package sso
 
-// Type SigninReply is returned from the signin functions.
+import (
+	"database/sql"
+	"net/http"
+)
+
+// Type SigninReply is returned from the signin functions.  If the member has
+// two-factor authentication, the first step of signing in only returns
+// Mtoken, which must be passed to SigninMFA along with a code.
 type SigninReply struct {
-	Rtoken        string  `json:"rtoken"`
-	RtokenExpires int64   `json:"rtoken_expires"`
-	Member        *Member `json:"member"`
+	Rtoken        string   `json:"rtoken,omitempty"`
+	RtokenExpires int64    `json:"rtoken_expires,omitempty"`
+	Mtoken        string   `json:"mtoken,omitempty"`
+	MtokenExpires int64    `json:"mtoken_expires,omitempty"`
+	MfaMethods    []string `json:"mfa_methods,omitempty"`
+	Member        *Member  `json:"member,omitempty"`
+	cookie        *http.Cookie
+}
+
+// Cookie returns the session cookie that should be set on the response, or
+// nil if there isn't a session yet.
+func (s *SigninReply) Cookie() *http.Cookie {
+	return s.cookie
 }
 
 // SigninEmail validates an email/password combination signs in the user with
-// a session cookie.
-func SigninEmail(email, password string) (*SigninReply, error) {
-	return &SigninReply{}, nil
+// a session cookie, or starts two-factor authentication if the member has it.
+func SigninEmail(r *http.Request, email, password string) (*SigninReply, error) {
+	mid, err := AuthEmail(email, password, ClientIP(r))
+	if err != nil {
+		return nil, err
+	}
+	return startSession(r, mid)
 }
 
 // SigninRefresh validates a refresh token and signs in the user with a
 // session cookie.
-func SigninRefresh(rtoken string) (*SigninReply, error) {
-	return &SigninReply{}, nil
+//
+// Refresh tokens are single use: the token presented is consumed and a new
+// one is returned in the reply.  If a token that has already been consumed is
+// presented again, then either it or its replacement has been stolen, so we
+// sign the member out everywhere.
+func SigninRefresh(r *http.Request, rtoken string) (*SigninReply, error) {
+
+	var (
+		reply    *SigninReply
+		replayed int64
+	)
+
+	err := inTx(func(t *sql.Tx) error {
+
+		var (
+			mid, signinAt, expiry int64
+			isMfa                 bool
+		)
+		if err := t.QueryRow(
+			"SELECT member_id, is_mfa, signin_at, expires_at FROM "+refreshTable+" WHERE rtoken=? FOR UPDATE",
+			rtoken).Scan(&mid, &isMfa, &signinAt, &expiry); err != nil {
+			if err != sql.ErrNoRows {
+				return err
+			}
+			if err := t.QueryRow(
+				"SELECT member_id FROM "+refreshUsedTable+" WHERE rtoken=?",
+				rtoken).Scan(&replayed); err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			return ErrInvalidRtoken
+		}
+
+		if _, err := t.Exec(
+			"DELETE FROM "+refreshTable+" WHERE rtoken=?",
+			rtoken); err != nil {
+			return err
+		}
+		if expiry < timestamp() {
+			// Commit the delete so that the expired token is cleaned up.
+			return nil
+		}
+
+		// Remember the consumed token until it would have expired, so that we
+		// can recognize it if it's replayed.
+		if _, err := t.Exec(
+			"INSERT INTO "+refreshUsedTable+" (rtoken, member_id, expires_at) VALUES (?,?,?)",
+			rtoken, mid, expiry); err != nil {
+			return err
+		}
+
+		m, err := getMember(mid)
+		if err != nil {
+			return err
+		}
+		m.mfa = isMfa
+		m.signinAt = signinAt
+
+		reply, err = issueSession(t, r, m)
+		return err
+	})
+
+	if replayed != 0 {
+		if err := revokeMember(db, replayed); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrInvalidRtoken
+	}
+	return reply, nil
 }
 
 // SigninSocial validates an id token from a social network and signs in the
-// user with a session cookie.
-func SigninSocial(provider, id_token string) (*SigninReply, error) {
-	return &SigninReply{}, nil
+// user with a session cookie.  See AuthSocial regarding the nonce.
+func SigninSocial(r *http.Request, provider, id_token, nonce string) (*SigninReply, error) {
+	mid, err := AuthSocial(provider, id_token, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return startSession(r, mid)
 }
@@ -0,0 +1,77 @@
+package sso
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// sessionsOf counts a member's sessions and refresh tokens.
+func sessionsOf(t *testing.T, mid int64) (active, refresh int) {
+	t.Helper()
+	if err := db.QueryRow("SELECT COUNT(*) FROM "+activeTable+" WHERE member_id=?", mid).Scan(&active); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM "+refreshTable+" WHERE member_id=?", mid).Scan(&refresh); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSigninRefreshDB(t *testing.T) {
+	testDB(t)
+
+	m := testMember(t)
+	r := httptest.NewRequest("POST", "/signin", nil)
+
+	// The member is signed in on two devices.
+	first, err := openSession(r, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openSession(r, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Refreshing swaps the token for a new one, and gives a new session.
+	rotated, err := SigninRefresh(r, first.Rtoken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Rtoken == "" || rotated.Rtoken == first.Rtoken || rotated.Cookie() == nil ||
+		rotated.Member.GetId() != m.id {
+		t.Fatalf("got %+v", rotated)
+	}
+
+	// The new token works too.
+	again, err := SigninRefresh(r, rotated.Rtoken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, refresh := sessionsOf(t, m.id); active != 4 || refresh != 2 {
+		t.Fatalf("before the replay: %d sessions, %d refresh tokens", active, refresh)
+	}
+
+	// Replaying the original token means it was stolen, so every session
+	// and refresh token the member has goes.
+	if _, err := SigninRefresh(r, first.Rtoken); err != ErrInvalidRtoken {
+		t.Errorf("replay: got %v", err)
+	}
+	if active, refresh := sessionsOf(t, m.id); active != 0 || refresh != 0 {
+		t.Errorf("after replay: %d sessions, %d refresh tokens", active, refresh)
+	}
+	for name, reply := range map[string]*SigninReply{"other device": other, "rotated": rotated, "latest": again} {
+		if _, err := SigninRefresh(r, reply.Rtoken); err != ErrInvalidRtoken {
+			t.Errorf("%s after replay: got %v", name, err)
+		}
+		cr := httptest.NewRequest("GET", "/", nil)
+		cr.AddCookie(reply.Cookie())
+		if cm, err := CurrentMember(cr); cm != nil || err != nil {
+			t.Errorf("%s session after replay: got %v, %v", name, cm, err)
+		}
+	}
+
+	if _, err := SigninRefresh(r, "bogus"); err != ErrInvalidRtoken {
+		t.Errorf("bogus token: got %v", err)
+	}
+}
@@ -5,7 +5,9 @@ package sso
 import (
 	"database/sql"
 	"net/http"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // Type Failure is the custom error type used for all API calls
@@ -37,6 +39,20 @@ var (
 	ErrInvalidAccount          = ErrorResponse{"account", "Account is invalid."}
 	ErrAlreadyPrimary          = ErrorResponse{"alreadyprimary", "That account is already primary."}
 	ErrCantRemovePrimary       = ErrorResponse{"cantremoveprimary", "Primary account can't be removed."}
+	ErrNoAccountEmail          = ErrorResponse{"accountemail", "That account has no email address."}
+	ErrInvalidOAuthState       = ErrorResponse{"oauthstate", "Invalid or expired sign-in attempt."}
+	ErrInvalidResetToken       = ErrorResponse{"ptoken", "Invalid or expired password reset link."}
+	ErrInvalidSigninLink       = ErrorResponse{"ltoken", "Invalid or expired sign-in link."}
+	ErrLockedOut               = ErrorResponse{"locked", "Too many failed attempts; try again later."}
+	ErrInvalidMfaToken         = ErrorResponse{"mtoken", "Invalid or expired two-factor sign-in."}
+	ErrInvalidMfaCode          = ErrorResponse{"mfacode", "Invalid two-factor authentication code."}
+	ErrMfaEnrolled             = ErrorResponse{"mfaenrolled", "Two-factor authentication is already set up."}
+	ErrMfaNotEnrolled          = ErrorResponse{"nomfa", "Two-factor authentication is not set up."}
+	ErrInvalidWebAuthn         = ErrorResponse{"webauthn", "Invalid or expired passkey response."}
+	ErrWebAuthnSignCount       = ErrorResponse{"signcount", "This passkey may have been copied and can't be used."}
+	ErrInvalidSession          = ErrorResponse{"session", "No such session."}
+	ErrReauthRequired          = ErrorResponse{"reauth", "Please confirm it's you first."}
+	ErrMfaRequired             = ErrorResponse{"mfarequired", "Please sign in with two-factor authentication first."}
 )
 
 // Type Member contains basic member information.
@@ -48,6 +64,9 @@ type Member struct {
 	data      string
 	roles     uint32
 	aToken    string
+	mfa       bool
+	signinAt  int64
+	reauthAt  int64
 }
 
 // GetId returns the unique internal ID for the member.
@@ -59,14 +78,61 @@ func (m *Member) GetId() int64 {
 //     m.HasRole(SuperRole | AdminRole)
 //     m.HasRole(SuperRole) || m.HasRole(AdminRole)  // equivalent
 func (m *Member) HasRole(roles uint32) bool {
-	return m.roles&roles != 0
+	return m.activeRoles()&roles != 0
 }
 
 // HasRoles returns true if ths memberr has all of the roles given.
 //     m.HasRole(SuperRole | AdminRole)
 //     m.HasRole(SuperRole) && m.HasRole(AdminRole)  // equivalent
 func (m *Member) HasRoles(roles uint32) bool {
-	return m.roles&roles == roles
+	return m.activeRoles()&roles == roles
+}
+
+// activeRoles returns the member's roles, less any in MfaRequiredRoles if
+// the session didn't pass two-factor authentication.
+func (m *Member) activeRoles() uint32 {
+	if m.mfa {
+		return m.roles
+	}
+	return m.roles &^ MfaRequiredRoles
+}
+
+// getMember loads the member record with the given id.  Returns
+// ErrDisabledAccount if the member exists but is not active.
+func getMember(mid int64) (*Member, error) {
+
+	m := Member{id: mid}
+	isActive := false
+	if err := db.QueryRow(
+		"SELECT email, fullname, shortname, is_active, roles FROM "+memberTable+" WHERE id=?",
+		mid).Scan(&m.Email, &m.FullName, &m.ShortName, &isActive, &m.roles); err != nil {
+		return nil, err
+	}
+	if !isActive {
+		return nil, ErrDisabledAccount
+	}
+	return &m, nil
+}
+
+// createMember inserts a new member record and returns its id.  Missing
+// names are filled in from whatever we do have.
+func createMember(ex execer, email, fullname, shortname string) (int64, error) {
+
+	if fullname == "" {
+		fullname = email[:strings.IndexByte(email+"@", '@')]
+	}
+	if f := strings.Fields(fullname); shortname == "" && len(f) > 0 {
+		shortname = f[0]
+	}
+
+	now := timestamp()
+	res, err := ex.Exec(
+		"INSERT INTO "+memberTable+" (email, fullname, shortname, created_at, active_at) VALUES (?,?,?,?,?)",
+		email, truncate(fullname, 50), truncate(shortname, 50), now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
 }
 
 // SetSessionData writes to the active table an arbitrary string,
@@ -101,6 +167,10 @@ func CurrentMember(r *http.Request) (*Member, error) {
 		memberId  int64
 		useragent string
 		isSession bool
+		isMfa     bool
+		createdAt int64
+		activeAt  int64
+		reauthAt  int64
 		data      string
 	)
 
@@ -115,7 +185,7 @@ func CurrentMember(r *http.Request) (*Member, error) {
 	} else {
 		// No Authorization header; look for a session cookie
 		for _, cookie := range r.Cookies() {
-			if cookie.Name == "sess" {
+			if cookie.Name == SessionCookie {
 				atoken = cookie.Value
 				break
 			}
@@ -126,51 +196,82 @@ func CurrentMember(r *http.Request) (*Member, error) {
 		isCookie = true
 	}
 
-	// Attempt to update the last activity BEFORE we read it.  If we read it
-	// first and the stale session cleaner kicks in before we've had a chance to
-	// update the last active time, then our session will get dropped on the NEXT
-	// call, which would be really awful nearly impossible-to-find sporadic  bug.
-	// If the session has already been dropped, then this update has no effect.
-	db.Exec("UPDATE "+activeTable+" SET active_at=?, ip=? WHERE atoken=?",
-		timestamp(), r.RemoteAddr, atoken)
+	// Lock the session while we check it, and update the last activity
+	// before letting go.  If we read it and the stale session cleaner kicked
+	// in before we'd had a chance to update the last active time, then this
+	// call would work but the session would be dropped on the NEXT call, which
+	// would be a really awful nearly impossible-to-find sporadic bug.  This
+	// way the janitor waits for the lock, then sees the new active time.
+	var m *Member
+	err := inTx(func(t *sql.Tx) error {
 
-	if err := db.QueryRow(
-		"SELECT member_id, useragent, is_session, data FROM "+activeTable+" WHERE atoken=?",
-		atoken).Scan(&memberId, &useragent, &isSession, &data); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+		if err := t.QueryRow(
+			"SELECT member_id, useragent, is_session, is_mfa, created_at, active_at, reauth_at, data FROM "+activeTable+" WHERE atoken=? FOR UPDATE",
+			atoken).Scan(&memberId, &useragent, &isSession, &isMfa, &createdAt, &activeAt, &reauthAt, &data); err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
 		}
-		return nil, err
-	}
 
-	// Check for fishiness.  If a session cookie is supplied as an Authorization
-	// token or vice versa, that's fishy.  If the user agent has changed, that's
-	// fishy.  If something is fishy, kill the session now.
-	if isSession != isCookie { // TODO: user agent
-		db.Exec("DELETE from "+activeTable+" WHERE atoken=?", atoken)
-		return nil, nil
-	}
+		// Check for fishiness.  If a session cookie is supplied as an Authorization
+		// token or vice versa, that's fishy.  If the user agent has changed, that's
+		// fishy.  If something is fishy, kill the session now.
+		if isSession != isCookie { // TODO: user agent
+			t.Exec("DELETE from "+activeTable+" WHERE atoken=?", atoken)
+			return nil
+		}
 
-	m := Member{}
-	isActive := false
-	if err := db.QueryRow(
-		"SELECT email, fullname, shortname, is_active, roles FROM "+memberTable+" WHERE id=?",
-		memberId).Scan(&m.Email, &m.FullName, &m.ShortName, &isActive, &m.roles); err != nil {
+		member, err := getMember(memberId)
+		if err == ErrDisabledAccount {
+			// The account has been disabled since the last access, so cancel the session.
+			t.Exec("DELETE from "+activeTable+" WHERE atoken=?", atoken)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// End the session if it's been idle too long or has simply gone on too
+		// long, going by the member's roles as well as the kind of session.
+		// The refresh token goes too, so that it can't bring the session back.
+		now := timestamp()
+		if timeoutsFor(isSession, member.roles).expired(createdAt, activeAt, now) {
+			t.Exec("DELETE from "+activeTable+" WHERE atoken=?", atoken)
+			if isSession {
+				t.Exec("DELETE from "+refreshTable+" WHERE member_id=?", memberId)
+			}
+			return nil
+		}
+
+		if _, err := t.Exec("UPDATE "+activeTable+" SET active_at=?, ip=? WHERE atoken=?",
+			now, r.RemoteAddr, atoken); err != nil {
+			return err
+		}
+
+		member.aToken = atoken
+		member.data = data
+		member.mfa = isMfa
+		member.signinAt = createdAt
+		member.reauthAt = reauthAt
+		m = member
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	if !isActive {
-		// The account has been disabled since the last access, so cancel the session.
-		db.Exec("DELETE from "+activeTable+" WHERE atoken=?", atoken)
-		return nil, nil
-	}
-
-	m.id = memberId
-	m.aToken = atoken
-	m.data = data
-	return &m, nil
+	return m, nil
 }
 
 // timestamp returns the rurrent unix time.  Tests could override this.
 func timestamp() int64 {
   return time.Now().Unix()
 }
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
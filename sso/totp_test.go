@@ -0,0 +1,111 @@
+package sso
+
+import (
+	"net/url"
+	"testing"
+)
+
+// rfc6238Key is the SHA1 key from the test vectors in RFC 6238, appendix B.
+var rfc6238Key = []byte("12345678901234567890")
+
+// The RFC gives 8-digit codes; ours are the last 6 digits of those.
+var rfc6238Vectors = []struct {
+	time int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		if code := totpCode(rfc6238Key, v.time/totpPeriod); code != v.code {
+			t.Errorf("time %d: got %s, want %s", v.time, code, v.code)
+		}
+	}
+}
+
+func TestTOTPMatch(t *testing.T) {
+
+	secret := totpEncoding.EncodeToString(rfc6238Key)
+	const now = 1111111109
+	step := int64(now / totpPeriod)
+
+	tests := []struct {
+		name  string
+		code  string
+		now   int64
+		after int64
+		want  int64
+	}{
+		{"current", "081804", now, 0, step},
+		{"spaces", "081 804", now, 0, step},
+		{"previous step", "081804", now + totpPeriod, 0, step},
+		{"next step", "081804", now - totpPeriod, 0, step},
+		{"too late", "081804", now + 2*totpPeriod, 0, -1},
+		{"too early", "081804", now - 2*totpPeriod, 0, -1},
+		{"already used", "081804", now, step, -1},
+		{"wrong code", "081805", now, 0, -1},
+		{"too short", "81804", now, 0, -1},
+		{"too long", "0081804", now, 0, -1},
+		{"empty", "", now, 0, -1},
+	}
+	for _, tt := range tests {
+		got, err := totpMatch(secret, tt.code, tt.now, tt.after)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got step %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Apps may show the secret in lower case.
+	lower := []byte(secret)
+	for i, c := range lower {
+		if c >= 'A' && c <= 'Z' {
+			lower[i] = c + 'a' - 'A'
+		}
+	}
+	if got, err := totpMatch(string(lower), "081804", now, 0); err != nil || got != step {
+		t.Errorf("lower case secret: got %d, %v", got, err)
+	}
+
+	if _, err := totpMatch("not base32!", "081804", now, 0); err == nil {
+		t.Error("bad secret: no error")
+	}
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	s := newTOTPSecret()
+	key, err := totpEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 20 {
+		t.Errorf("got %d bytes, want 20", len(key))
+	}
+	if newTOTPSecret() == s {
+		t.Error("two secrets are the same")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(totpURI("ABCDEFGH", "me@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/"+TOTPIssuer+":me@example.com" {
+		t.Errorf("got %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != "ABCDEFGH" || q.Get("issuer") != TOTPIssuer ||
+		q.Get("digits") != "6" || q.Get("period") != "30" || q.Get("algorithm") != "SHA1" {
+		t.Errorf("got query %v", q)
+	}
+}
@@ -0,0 +1,628 @@
+package sso
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// WebAuthn settings.  WebAuthnRPID is the domain that passkeys are bound to,
+// and WebAuthnOrigins are the origins of the pages allowed to use them.
+// WebAuthnTimeout is the number of seconds the member has to respond.
+var (
+	WebAuthnRPID          = "localhost"
+	WebAuthnRPName        = "fsso"
+	WebAuthnOrigins       = []string{"http://localhost:8000"}
+	WebAuthnTimeout int64 = 300
+)
+
+// Authenticator data flags.
+const (
+	flagUP = 0x01 // user present
+	flagUV = 0x04 // user verified
+	flagAT = 0x40 // attested credential data included
+	flagED = 0x80 // extension data included
+)
+
+// aaguidOID is the certificate extension that packed attestation
+// certificates may use to name the authenticator model.
+var aaguidOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// Type WebAuthnCredential is a PublicKeyCredential as the browser returns it
+// from navigator.credentials.create or get, in the form given by its toJSON
+// method: binary fields are base64url-encoded.
+type WebAuthnCredential struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject,omitempty"`
+		AuthenticatorData string `json:"authenticatorData,omitempty"`
+		Signature         string `json:"signature,omitempty"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// Type Passkey describes one of a member's WebAuthn credentials.
+type Passkey struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"created_at"`
+	UsedAt    int64  `json:"used_at"`
+}
+
+// Type clientData is the part of the client data that we check.
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// Type authData is parsed authenticator data.  The credential fields are
+// only set when registering.
+type authData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	aaguid    []byte
+	credID    []byte
+	key       *coseKey
+	keyRaw    []byte
+}
+
+// BeginWebAuthnRegistration starts adding a passkey for the member.  It
+// returns the options to pass to navigator.credentials.create, with binary
+// fields base64url-encoded.  A passkey is a way to sign in, so the member
+// must have reauthenticated recently (see requireRecentAuth).
+func (m *Member) BeginWebAuthnRegistration() (map[string]interface{}, error) {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return nil, err
+	}
+
+	challenge, err := newWebAuthnChallenge(m.id, "create")
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := m.Passkeys()
+	if err != nil {
+		return nil, err
+	}
+	exclude := make([]map[string]string, len(passkeys))
+	for i, p := range passkeys {
+		exclude[i] = map[string]string{"type": "public-key", "id": p.ID}
+	}
+
+	params := make([]map[string]interface{}, len(coseAlgs))
+	for i, alg := range coseAlgs {
+		params[i] = map[string]interface{}{"type": "public-key", "alg": alg}
+	}
+
+	return map[string]interface{}{
+		"rp":                 map[string]string{"id": WebAuthnRPID, "name": WebAuthnRPName},
+		"user":               map[string]string{"id": webAuthnUserHandle(m.id), "name": m.Email, "displayName": m.FullName},
+		"challenge":          challenge,
+		"pubKeyCredParams":   params,
+		"timeout":            WebAuthnTimeout * 1000,
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+	}, nil
+}
+
+// FinishWebAuthnRegistration checks the credential that the browser created
+// from the options given by BeginWebAuthnRegistration, and saves it as one of
+// the member's passkeys under the given name.
+//
+// Attestation in the "none" and "packed" formats is accepted.  Packed
+// attestation is checked for consistency, but its certificate isn't checked
+// against any list of trusted authenticators.
+//
+// The current session counts as having passed two-factor authentication
+// from then on.
+func (m *Member) FinishWebAuthnRegistration(c *WebAuthnCredential, name string) error {
+
+	clientDataJSON, err1 := unb64url(c.Response.ClientDataJSON)
+	attObj, err2 := unb64url(c.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		return ErrInvalidWebAuthn
+	}
+
+	cd, err := checkClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		return err
+	}
+	if err := useWebAuthnChallenge(cd.Challenge, m.id, "create"); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(clientDataJSON)
+	ad, err := verifyAttestation(attObj, hash[:])
+	if err != nil {
+		return err
+	}
+	if err := ad.check(false); err != nil {
+		return err
+	}
+
+	id := b64url(ad.credID)
+	if id != c.ID || len(id) > 255 {
+		return ErrInvalidWebAuthn
+	}
+
+	// As with ConfirmTOTP, the member has just shown that they have the
+	// second factor.
+	err = inTx(func(t *sql.Tx) error {
+		if _, err := t.Exec(
+			"INSERT INTO "+webauthnAuthTable+" (credential_id, member_id, public_key, sign_count, name, created_at, used_at) VALUES (?,?,?,?,?,?,?)",
+			id, m.id, ad.keyRaw, ad.signCount, truncate(name, 50), timestamp(), 0); err != nil {
+			if isDuplicate(err) {
+				return ErrDuplicateAccount
+			}
+			return err
+		}
+		_, err := t.Exec(
+			"UPDATE "+activeTable+" SET is_mfa=1 WHERE atoken=?",
+			m.aToken)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mfa = true
+	return nil
+}
+
+// Passkeys lists the member's passkeys.
+func (m *Member) Passkeys() ([]*Passkey, error) {
+
+	rows, err := db.Query(
+		"SELECT credential_id, name, created_at, used_at FROM "+webauthnAuthTable+" WHERE member_id=? ORDER BY created_at",
+		m.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+	for rows.Next() {
+		p := &Passkey{}
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.UsedAt); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+// RemovePasskey removes one of the member's passkeys.  As with adding one,
+// the member must have reauthenticated recently.
+func (m *Member) RemovePasskey(id string) error {
+
+	if err := m.requireRecentAuth(); err != nil {
+		return err
+	}
+
+	res, err := db.Exec(
+		"DELETE FROM "+webauthnAuthTable+" WHERE credential_id=? AND member_id=?",
+		id, m.id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidAccount
+	}
+	return nil
+}
+
+// BeginWebAuthnSignin returns the options to pass to
+// navigator.credentials.get, with binary fields base64url-encoded.  With no
+// mtoken, any passkey may be used to sign in, and it must verify the member
+// (with a PIN or biometric, say), since it's the only factor.  With the
+// mtoken from the first step of signing in, only that member's passkeys may
+// be used, as a second factor.
+func BeginWebAuthnSignin(mtoken string) (map[string]interface{}, error) {
+
+	var mid int64
+	allow := []map[string]string{}
+	verification := "required"
+
+	if mtoken != "" {
+		var expiry int64
+		if err := db.QueryRow(
+			"SELECT member_id, expires_at FROM "+mfaChallengeTable+" WHERE mtoken=?",
+			mtoken).Scan(&mid, &expiry); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, ErrInvalidMfaToken
+			}
+			return nil, err
+		}
+		if expiry < timestamp() {
+			return nil, ErrInvalidMfaToken
+		}
+		passkeys, err := (&Member{id: mid}).Passkeys()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range passkeys {
+			allow = append(allow, map[string]string{"type": "public-key", "id": p.ID})
+		}
+		verification = "preferred"
+	}
+
+	challenge, err := newWebAuthnChallenge(mid, "get")
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             WebAuthnRPID,
+		"timeout":          WebAuthnTimeout * 1000,
+		"allowCredentials": allow,
+		"userVerification": verification,
+	}, nil
+}
+
+// SigninWebAuthn signs in the member with a passkey, using a credential from
+// the options given by BeginWebAuthnSignin with no mtoken.  Since the passkey
+// verified the member, the session counts as having passed two-factor
+// authentication.
+func SigninWebAuthn(r *http.Request, c *WebAuthnCredential) (*SigninReply, error) {
+	m, err := passkeyMember(c)
+	if err != nil {
+		return nil, err
+	}
+	return openSession(r, m)
+}
+
+// ConnectWebAuthn is like SigninWebAuthn, for a token-based session.
+func ConnectWebAuthn(r *http.Request, c *WebAuthnCredential) (*ConnectReply, error) {
+	m, err := passkeyMember(c)
+	if err != nil {
+		return nil, err
+	}
+	return openConnection(r, m)
+}
+
+// SigninMFAWebAuthn is like SigninMFA, with a passkey as the second factor.
+func SigninMFAWebAuthn(r *http.Request, mtoken string, c *WebAuthnCredential) (*SigninReply, error) {
+	m, err := passChallenge(mtoken, true, passkeyCheck(c))
+	if err != nil {
+		return nil, err
+	}
+	return openSession(r, m)
+}
+
+// ConnectMFAWebAuthn is like ConnectMFA, with a passkey as the second factor.
+func ConnectMFAWebAuthn(r *http.Request, mtoken string, c *WebAuthnCredential) (*ConnectReply, error) {
+	m, err := passChallenge(mtoken, false, passkeyCheck(c))
+	if err != nil {
+		return nil, err
+	}
+	return openConnection(r, m)
+}
+
+// passkeyMember authenticates a member with a passkey alone.
+func passkeyMember(c *WebAuthnCredential) (*Member, error) {
+	mid, err := authWebAuthn(0, c)
+	if err != nil {
+		return nil, err
+	}
+	m, err := getMember(mid)
+	if err != nil {
+		return nil, err
+	}
+	m.mfa = true
+	return m, nil
+}
+
+// passkeyCheck returns a check for passChallenge that the member used one of
+// their passkeys.
+func passkeyCheck(c *WebAuthnCredential) func(int64) error {
+	return func(mid int64) error {
+		_, err := authWebAuthn(mid, c)
+		return err
+	}
+}
+
+// authWebAuthn checks a credential from the options given by
+// BeginWebAuthnSignin, and returns the id of the member whose passkey it is.
+// mid is the member that the options were for, or 0 if they were for anyone;
+// in that case the passkey must have verified the member.
+func authWebAuthn(mid int64, c *WebAuthnCredential) (int64, error) {
+
+	clientDataJSON, err1 := unb64url(c.Response.ClientDataJSON)
+	authDataRaw, err2 := unb64url(c.Response.AuthenticatorData)
+	sig, err3 := unb64url(c.Response.Signature)
+	userHandle, err4 := unb64url(c.Response.UserHandle)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return 0, ErrInvalidWebAuthn
+	}
+
+	cd, err := checkClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		return 0, err
+	}
+	if err := useWebAuthnChallenge(cd.Challenge, mid, "get"); err != nil {
+		return 0, err
+	}
+
+	var (
+		owner     int64
+		keyRaw    []byte
+		signCount uint32
+	)
+	if err := db.QueryRow(
+		"SELECT member_id, public_key, sign_count FROM "+webauthnAuthTable+" WHERE credential_id=?",
+		c.ID).Scan(&owner, &keyRaw, &signCount); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrInvalidWebAuthn
+		}
+		return 0, err
+	}
+	if mid != 0 && owner != mid {
+		return 0, ErrInvalidWebAuthn
+	}
+	if len(userHandle) > 0 && b64url(userHandle) != webAuthnUserHandle(owner) {
+		return 0, ErrInvalidWebAuthn
+	}
+
+	ad, err := parseAuthData(authDataRaw)
+	if err != nil {
+		return 0, err
+	}
+	if err := ad.check(mid == 0); err != nil {
+		return 0, err
+	}
+
+	key, _, err := parseCOSEKey(keyRaw)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authDataRaw...), hash[:]...)
+	if !key.verify(signed, sig) {
+		return 0, ErrInvalidWebAuthn
+	}
+
+	// Authenticators that keep a signature counter must always increase it.
+	// If one goes backwards, the passkey has probably been cloned.
+	if (ad.signCount != 0 || signCount != 0) && ad.signCount <= signCount {
+		log.Printf("webauthn: sign count went from %d to %d for member %d", signCount, ad.signCount, owner)
+		return 0, ErrWebAuthnSignCount
+	}
+
+	// Only move the counter forwards, so that if two signins with the same
+	// count race each other, one of them fails.  Authenticators without a
+	// counter always send 0, so there's nothing to race over.
+	if ad.signCount == 0 {
+		_, err = db.Exec(
+			"UPDATE "+webauthnAuthTable+" SET used_at=? WHERE credential_id=?",
+			timestamp(), c.ID)
+		if err != nil {
+			return 0, err
+		}
+		return owner, nil
+	}
+	res, err := db.Exec(
+		"UPDATE "+webauthnAuthTable+" SET sign_count=?, used_at=? WHERE credential_id=? AND sign_count<?",
+		ad.signCount, timestamp(), c.ID, ad.signCount)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("webauthn: sign count %d was used twice for member %d", ad.signCount, owner)
+		return 0, ErrWebAuthnSignCount
+	}
+	return owner, nil
+}
+
+// newWebAuthnChallenge stores and returns a new challenge for a member (or 0
+// for anyone) and purpose ("create" or "get").
+func newWebAuthnChallenge(mid int64, purpose string) (string, error) {
+	expiry := timestamp() + WebAuthnTimeout
+	for {
+		challenge := RandomToken(43) // 32 bytes
+		if _, err := db.Exec(
+			"INSERT INTO "+webauthnChallengeTable+" (challenge, member_id, purpose, expires_at) VALUES (?,?,?,?)",
+			challenge, mid, purpose, expiry); err != nil {
+			if isDuplicate(err) {
+				continue
+			}
+			return "", err
+		}
+		return challenge, nil
+	}
+}
+
+// useWebAuthnChallenge uses up a challenge, which must have been made for the
+// same member and purpose.
+func useWebAuthnChallenge(challenge string, mid int64, purpose string) error {
+	res, err := db.Exec(
+		"DELETE FROM "+webauthnChallengeTable+" WHERE challenge=? AND member_id=? AND purpose=? AND expires_at>=?",
+		challenge, mid, purpose, timestamp())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidWebAuthn
+	}
+	return nil
+}
+
+// checkClientData parses the client data and checks its type and origin.
+func checkClientData(raw []byte, typ string) (*clientData, error) {
+	cd := &clientData{}
+	if err := json.Unmarshal(raw, cd); err != nil {
+		return nil, ErrInvalidWebAuthn
+	}
+	if cd.Type != typ || cd.CrossOrigin {
+		return nil, ErrInvalidWebAuthn
+	}
+	for _, origin := range WebAuthnOrigins {
+		if cd.Origin == origin {
+			return cd, nil
+		}
+	}
+	return nil, ErrInvalidWebAuthn
+}
+
+// verifyAttestation parses an attestation object, checks the attestation
+// statement, and returns the authenticator data.
+func verifyAttestation(obj, clientDataHash []byte) (*authData, error) {
+
+	v, rest, err := cborDecode(obj)
+	if err != nil || len(rest) > 0 {
+		return nil, ErrInvalidWebAuthn
+	}
+	m, _ := v.(map[interface{}]interface{})
+	format, _ := m["fmt"].(string)
+	stmt, _ := m["attStmt"].(map[interface{}]interface{})
+	raw, _ := m["authData"].([]byte)
+	if stmt == nil || raw == nil {
+		return nil, ErrInvalidWebAuthn
+	}
+
+	ad, err := parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ad.key == nil {
+		return nil, ErrInvalidWebAuthn
+	}
+
+	switch format {
+
+	case "none":
+		if len(stmt) != 0 {
+			return nil, ErrInvalidWebAuthn
+		}
+
+	case "packed":
+		alg, _ := stmt["alg"].(int64)
+		sig, _ := stmt["sig"].([]byte)
+		signed := append(append([]byte(nil), raw...), clientDataHash...)
+
+		if x5c, ok := stmt["x5c"].([]interface{}); ok {
+			// Signed by an attestation certificate.
+			if len(x5c) == 0 {
+				return nil, ErrInvalidWebAuthn
+			}
+			der, _ := x5c[0].([]byte)
+			cert, err := x509.ParseCertificate(der)
+			if err != nil || cert.Version != 3 || !verifySig(alg, cert.PublicKey, signed, sig) {
+				return nil, ErrInvalidWebAuthn
+			}
+			for _, ext := range cert.Extensions {
+				if !ext.Id.Equal(aaguidOID) {
+					continue
+				}
+				var aaguid []byte
+				if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || !bytes.Equal(aaguid, ad.aaguid) {
+					return nil, ErrInvalidWebAuthn
+				}
+			}
+		} else {
+			// Self attestation, signed by the credential itself.
+			if alg != ad.key.alg || !ad.key.verify(signed, sig) {
+				return nil, ErrInvalidWebAuthn
+			}
+		}
+
+	default:
+		return nil, ErrInvalidWebAuthn
+	}
+
+	return ad, nil
+}
+
+// parseAuthData parses authenticator data.
+func parseAuthData(b []byte) (*authData, error) {
+
+	if len(b) < 37 {
+		return nil, ErrInvalidWebAuthn
+	}
+	ad := &authData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	rest := b[37:]
+
+	if ad.flags&flagAT != 0 {
+		if len(rest) < 18 {
+			return nil, ErrInvalidWebAuthn
+		}
+		ad.aaguid = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > len(rest) {
+			return nil, ErrInvalidWebAuthn
+		}
+		ad.credID, rest = rest[:n], rest[n:]
+
+		key, after, err := parseCOSEKey(rest)
+		if err != nil {
+			return nil, ErrInvalidWebAuthn
+		}
+		ad.key, ad.keyRaw, rest = key, rest[:len(rest)-len(after)], after
+	}
+
+	// Extensions are allowed but ignored.
+	if ad.flags&flagED != 0 {
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, ErrInvalidWebAuthn
+		}
+		rest = after
+	}
+	if len(rest) > 0 {
+		return nil, ErrInvalidWebAuthn
+	}
+	return ad, nil
+}
+
+// check checks that the authenticator data is for us and that the member was
+// present, and also verified if needUV is true.
+func (ad *authData) check(needUV bool) error {
+	hash := sha256.Sum256([]byte(WebAuthnRPID))
+	if subtle.ConstantTimeCompare(ad.rpIDHash, hash[:]) != 1 || ad.flags&flagUP == 0 {
+		return ErrInvalidWebAuthn
+	}
+	if needUV && ad.flags&flagUV == 0 {
+		return ErrInvalidWebAuthn
+	}
+	return nil
+}
+
+// webAuthnUserHandle is the user id that a member's passkeys are created
+// with.  It's the member id, since that's opaque and never changes.
+func webAuthnUserHandle(mid int64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(mid))
+	return b64url(b[:])
+}
+
+// b64url and unb64url use the unpadded base64url encoding of WebAuthn.
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func unb64url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,571 @@
+package sso
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Type softAuthenticator plays the part of a WebAuthn authenticator and the
+// browser in front of it, with an ES256 key.
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	credID    []byte
+	aaguid    []byte
+	rpID      string
+	origin    string
+	flags     byte
+	signCount uint32
+	userID    string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softAuthenticator{
+		key:    key,
+		credID: credID,
+		aaguid: []byte("fsso soft authnr"),
+		rpID:   WebAuthnRPID,
+		origin: WebAuthnOrigins[0],
+		flags:  flagUP | flagUV,
+	}
+}
+
+// authData returns authenticator data, with the attested credential if
+// attested is true.
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	b := append([]byte(nil), rpIDHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= flagAT
+	}
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	if attested {
+		b = append(b, a.aaguid...)
+		b = append(b, byte(len(a.credID)>>8), byte(len(a.credID)))
+		b = append(b, a.credID...)
+		b = append(b, cborEncode(coseKeyMap(&a.key.PublicKey))...)
+	}
+	return b
+}
+
+// clientData returns the client data the browser would make.
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	return b
+}
+
+// attestation returns an attestation object in the given format: "none",
+// "packed" for self attestation, or "packed-x5c" for attestation with a
+// certificate.
+func (a *softAuthenticator) attestation(t *testing.T, authData, clientData []byte, format string) []byte {
+	t.Helper()
+	hash := sha256.Sum256(clientData)
+	signed := append(append([]byte(nil), authData...), hash[:]...)
+
+	stmt := map[interface{}]interface{}{}
+	switch format {
+	case "packed":
+		stmt["alg"] = int64(coseES256)
+		stmt["sig"] = coseSign(t, a.key, signed)
+	case "packed-x5c":
+		certKey, der := attestationCert(t, a.aaguid)
+		stmt["alg"] = int64(coseES256)
+		stmt["sig"] = coseSign(t, certKey, signed)
+		stmt["x5c"] = []interface{}{der}
+		format = "packed"
+	}
+	return cborEncode(map[interface{}]interface{}{
+		"fmt":      format,
+		"attStmt":  stmt,
+		"authData": authData,
+	})
+}
+
+// create makes a new credential for navigator.credentials.create.
+func (a *softAuthenticator) create(t *testing.T, challenge, format string) *WebAuthnCredential {
+	t.Helper()
+	cd := a.clientData("webauthn.create", challenge)
+	c := &WebAuthnCredential{ID: b64url(a.credID), Type: "public-key"}
+	c.Response.ClientDataJSON = b64url(cd)
+	c.Response.AttestationObject = b64url(a.attestation(t, a.authData(true), cd, format))
+	return c
+}
+
+// get makes an assertion for navigator.credentials.get, moving the
+// signature counter on first.
+func (a *softAuthenticator) get(t *testing.T, challenge string) *WebAuthnCredential {
+	t.Helper()
+	a.signCount++
+	cd := a.clientData("webauthn.get", challenge)
+	ad := a.authData(false)
+	hash := sha256.Sum256(cd)
+	c := &WebAuthnCredential{ID: b64url(a.credID), Type: "public-key"}
+	c.Response.ClientDataJSON = b64url(cd)
+	c.Response.AuthenticatorData = b64url(ad)
+	c.Response.Signature = b64url(coseSign(t, a.key, append(append([]byte(nil), ad...), hash[:]...)))
+	c.Response.UserHandle = a.userID
+	return c
+}
+
+// attestationCert makes a packed attestation certificate naming aaguid, and
+// returns its key and DER.
+func attestationCert(t *testing.T, aaguid []byte) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext, _ := asn1.Marshal(aaguid)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Country:            []string{"MY"},
+			Organization:       []string{"fsso"},
+			OrganizationalUnit: []string{"Authenticator Attestation"},
+			CommonName:         "fsso test",
+		},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: aaguidOID, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, der
+}
+
+// attest runs verifyAttestation on a credential from create.
+func attest(c *WebAuthnCredential) (*authData, error) {
+	cd, _ := unb64url(c.Response.ClientDataJSON)
+	obj, _ := unb64url(c.Response.AttestationObject)
+	hash := sha256.Sum256(cd)
+	return verifyAttestation(obj, hash[:])
+}
+
+func TestWebAuthnAttestation(t *testing.T) {
+
+	for _, format := range []string{"none", "packed", "packed-x5c"} {
+		a := newSoftAuthenticator(t)
+		ad, err := attest(a.create(t, "challenge", format))
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		if err := ad.check(true); err != nil {
+			t.Errorf("%s: check: %v", format, err)
+		}
+		if b64url(ad.credID) != b64url(a.credID) || ad.key == nil || ad.key.alg != coseES256 {
+			t.Errorf("%s: got %+v", format, ad)
+		}
+	}
+}
+
+func TestWebAuthnAttestationBad(t *testing.T) {
+
+	a := newSoftAuthenticator(t)
+	cd := a.clientData("webauthn.create", "challenge")
+	hash := sha256.Sum256(cd)
+	ad := a.authData(true)
+
+	// spoilt re-encodes a good attestation object with f applied to it.
+	spoilt := func(format string, f func(m map[interface{}]interface{})) []byte {
+		v, _, _ := cborDecode(a.attestation(t, ad, cd, format))
+		m := v.(map[interface{}]interface{})
+		f(m)
+		return cborEncode(m)
+	}
+	stmt := func(m map[interface{}]interface{}) map[interface{}]interface{} {
+		return m["attStmt"].(map[interface{}]interface{})
+	}
+
+	other := newSoftAuthenticator(t)
+	other.aaguid = []byte("someone else!!!!")
+	_, otherCert := attestationCert(t, other.aaguid)
+
+	tests := map[string][]byte{
+		"unknown format":     spoilt("none", func(m map[interface{}]interface{}) { m["fmt"] = "fido-u2f" }),
+		"none with stmt":     spoilt("none", func(m map[interface{}]interface{}) { stmt(m)["sig"] = []byte{1} }),
+		"no attStmt":         spoilt("none", func(m map[interface{}]interface{}) { delete(m, "attStmt") }),
+		"no authData":        spoilt("none", func(m map[interface{}]interface{}) { delete(m, "authData") }),
+		"no credential":      spoilt("none", func(m map[interface{}]interface{}) { m["authData"] = a.authData(false) }),
+		"self, bad sig":      spoilt("packed", func(m map[interface{}]interface{}) { stmt(m)["sig"] = coseSign(t, other.key, ad) }),
+		"self, no sig":       spoilt("packed", func(m map[interface{}]interface{}) { delete(stmt(m), "sig") }),
+		"self, wrong alg":    spoilt("packed", func(m map[interface{}]interface{}) { stmt(m)["alg"] = int64(coseRS256) }),
+		"x5c, empty":         spoilt("packed-x5c", func(m map[interface{}]interface{}) { stmt(m)["x5c"] = []interface{}{} }),
+		"x5c, not a cert":    spoilt("packed-x5c", func(m map[interface{}]interface{}) { stmt(m)["x5c"] = []interface{}{[]byte("junk")} }),
+		"x5c, other cert":    spoilt("packed-x5c", func(m map[interface{}]interface{}) { stmt(m)["x5c"] = []interface{}{otherCert} }),
+		"trailing bytes":     append(a.attestation(t, ad, cd, "none"), 0),
+		"not a map":          cborEncode([]interface{}{"none"}),
+		"authData too short": spoilt("none", func(m map[interface{}]interface{}) { m["authData"] = ad[:36] }),
+	}
+	for name, obj := range tests {
+		if _, err := verifyAttestation(obj, hash[:]); err != ErrInvalidWebAuthn {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	// The certificate must vouch for the authenticator's model.
+	key, der := attestationCert(t, other.aaguid)
+	signed := append(append([]byte(nil), ad...), hash[:]...)
+	obj := cborEncode(map[interface{}]interface{}{
+		"fmt":      "packed",
+		"attStmt":  map[interface{}]interface{}{"alg": int64(coseES256), "sig": coseSign(t, key, signed), "x5c": []interface{}{der}},
+		"authData": ad,
+	})
+	if _, err := verifyAttestation(obj, hash[:]); err != ErrInvalidWebAuthn {
+		t.Errorf("aaguid mismatch: got %v", err)
+	}
+
+	// The statement covers the client data.
+	for _, format := range []string{"packed", "packed-x5c"} {
+		other := sha256.Sum256([]byte("other client data"))
+		if _, err := verifyAttestation(a.attestation(t, ad, cd, format), other[:]); err != ErrInvalidWebAuthn {
+			t.Errorf("%s, other client data: got %v", format, err)
+		}
+	}
+}
+
+func TestWebAuthnTruncated(t *testing.T) {
+
+	a := newSoftAuthenticator(t)
+	cd := a.clientData("webauthn.create", "challenge")
+	hash := sha256.Sum256(cd)
+	ad := a.authData(true)
+
+	for _, format := range []string{"none", "packed", "packed-x5c"} {
+		obj := a.attestation(t, ad, cd, format)
+		for i := 0; i < len(obj); i++ {
+			if _, err := verifyAttestation(obj[:i], hash[:]); err == nil {
+				t.Errorf("%s truncated to %d bytes: no error", format, i)
+			}
+		}
+		// Flipping bits anywhere mustn't make it panic.
+		for i := 0; i < len(obj); i++ {
+			b := append([]byte(nil), obj...)
+			b[i] ^= 0xff
+			verifyAttestation(b, hash[:])
+		}
+	}
+
+	for i := 0; i < len(ad); i++ {
+		if _, err := parseAuthData(ad[:i]); err == nil {
+			t.Errorf("authData truncated to %d bytes: no error", i)
+		}
+	}
+	if _, err := parseAuthData(append(ad, 0)); err == nil {
+		t.Error("authData with trailing bytes: no error")
+	}
+
+	// Extensions may follow, as long as they're well formed.
+	a.flags |= flagED
+	ext := cborEncode(map[interface{}]interface{}{"credProtect": int64(1)})
+	if _, err := parseAuthData(append(a.authData(true), ext...)); err != nil {
+		t.Errorf("extensions: %v", err)
+	}
+	if _, err := parseAuthData(append(a.authData(true), ext[:len(ext)-1]...)); err == nil {
+		t.Error("truncated extensions: no error")
+	}
+}
+
+func TestWebAuthnClientData(t *testing.T) {
+
+	a := newSoftAuthenticator(t)
+	if cd, err := checkClientData(a.clientData("webauthn.get", "c"), "webauthn.get"); err != nil || cd.Challenge != "c" {
+		t.Errorf("good: got %+v, %v", cd, err)
+	}
+
+	cross, _ := json.Marshal(map[string]interface{}{"type": "webauthn.get", "challenge": "c", "origin": a.origin, "crossOrigin": true})
+	evil := newSoftAuthenticator(t)
+	evil.origin = "https://evil.example.com"
+
+	tests := map[string][]byte{
+		"wrong type":   a.clientData("webauthn.create", "c"),
+		"wrong origin": evil.clientData("webauthn.get", "c"),
+		"cross origin": cross,
+		"not json":     []byte("{"),
+	}
+	for name, raw := range tests {
+		if _, err := checkClientData(raw, "webauthn.get"); err != ErrInvalidWebAuthn {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestWebAuthnAuthDataCheck(t *testing.T) {
+
+	a := newSoftAuthenticator(t)
+	check := func(needUV bool) error {
+		ad, err := parseAuthData(a.authData(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ad.check(needUV)
+	}
+
+	if err := check(true); err != nil {
+		t.Errorf("good: %v", err)
+	}
+
+	a.rpID = "evil.example.com"
+	if err := check(false); err != ErrInvalidWebAuthn {
+		t.Errorf("wrong rpId: got %v", err)
+	}
+	a.rpID = WebAuthnRPID
+
+	a.flags = flagUP
+	if err := check(false); err != nil {
+		t.Errorf("second factor without UV: %v", err)
+	}
+	if err := check(true); err != ErrInvalidWebAuthn {
+		t.Errorf("passkey alone without UV: got %v", err)
+	}
+
+	a.flags = flagUV
+	if err := check(false); err != ErrInvalidWebAuthn {
+		t.Errorf("without UP: got %v", err)
+	}
+}
+
+// TestWebAuthnAssertion follows authWebAuthn's checks of an assertion,
+// without the database.
+func TestWebAuthnAssertion(t *testing.T) {
+
+	a := newSoftAuthenticator(t)
+	reg, err := attest(a.create(t, "challenge", "none"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := parseCOSEKey(reg.keyRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(c *WebAuthnCredential) bool {
+		cd, _ := unb64url(c.Response.ClientDataJSON)
+		raw, _ := unb64url(c.Response.AuthenticatorData)
+		sig, _ := unb64url(c.Response.Signature)
+		if _, err := checkClientData(cd, "webauthn.get"); err != nil {
+			return false
+		}
+		ad, err := parseAuthData(raw)
+		if err != nil || ad.check(true) != nil {
+			return false
+		}
+		hash := sha256.Sum256(cd)
+		return key.verify(append(append([]byte(nil), raw...), hash[:]...), sig)
+	}
+
+	if !verify(a.get(t, "c1")) {
+		t.Error("good assertion rejected")
+	}
+
+	// Signed by a different authenticator claiming the same credential.
+	clone := newSoftAuthenticator(t)
+	clone.credID = a.credID
+	if verify(clone.get(t, "c2")) {
+		t.Error("assertion from another key accepted")
+	}
+
+	// Client data swapped after signing.
+	c := a.get(t, "c3")
+	c.Response.ClientDataJSON = b64url(a.clientData("webauthn.get", "c4"))
+	if verify(c) {
+		t.Error("assertion with other client data accepted")
+	}
+
+	a.rpID = "evil.example.com"
+	if verify(a.get(t, "c5")) {
+		t.Error("assertion for another rpId accepted")
+	}
+	a.rpID = WebAuthnRPID
+
+	a.origin = "https://evil.example.com"
+	if verify(a.get(t, "c6")) {
+		t.Error("assertion from another origin accepted")
+	}
+}
+
+// The rest need a database loaded with mysql/schema.sql.  Since the test
+// suite trashes it, it's only used if MYSQL_TEST_DSN is set.
+
+var testDBOnce sync.Once
+
+// testDB skips the test unless there's a test database, and connects to it.
+func testDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_TEST_DSN not set")
+	}
+	testDBOnce.Do(func() { InitDB(dsn) })
+}
+
+// testMember creates a member who has just signed in, and deletes them when
+// the test is done.
+func testMember(t *testing.T) *Member {
+	t.Helper()
+	mid, err := createMember(db, RandomToken(16)+"@example.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM "+memberTable+" WHERE id=?", mid) })
+	m, err := getMember(mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.signinAt = timestamp()
+	m.reauthAt = m.signinAt
+	return m
+}
+
+// register adds a passkey for m from a, in the given attestation format.
+func register(t *testing.T, m *Member, a *softAuthenticator, format string) error {
+	t.Helper()
+	opts, err := m.BeginWebAuthnRegistration()
+	if err != nil {
+		return err
+	}
+	return m.FinishWebAuthnRegistration(a.create(t, opts["challenge"].(string), format), "test")
+}
+
+func TestWebAuthnRegistrationDB(t *testing.T) {
+	testDB(t)
+
+	m := testMember(t)
+	for _, format := range []string{"none", "packed", "packed-x5c"} {
+		if err := register(t, m, newSoftAuthenticator(t), format); err != nil {
+			t.Errorf("%s: %v", format, err)
+		}
+	}
+	if passkeys, err := m.Passkeys(); err != nil || len(passkeys) != 3 {
+		t.Errorf("got %v, %v", passkeys, err)
+	}
+
+	// A challenge can only be used once.
+	opts, err := m.BeginWebAuthnRegistration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := opts["challenge"].(string)
+	if err := m.FinishWebAuthnRegistration(newSoftAuthenticator(t).create(t, challenge, "none"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FinishWebAuthnRegistration(newSoftAuthenticator(t).create(t, challenge, "none"), ""); err != ErrInvalidWebAuthn {
+		t.Errorf("challenge reused: got %v", err)
+	}
+
+	// Nor can another member's.
+	other := testMember(t)
+	opts, err = other.BeginWebAuthnRegistration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FinishWebAuthnRegistration(newSoftAuthenticator(t).create(t, opts["challenge"].(string), "none"), ""); err != ErrInvalidWebAuthn {
+		t.Errorf("other member's challenge: got %v", err)
+	}
+}
+
+func TestWebAuthnRegistrationNeedsReauthDB(t *testing.T) {
+	testDB(t)
+
+	m := testMember(t)
+	m.reauthAt = timestamp() - ReauthLifetime - 1
+	if _, err := m.BeginWebAuthnRegistration(); err != ErrReauthRequired {
+		t.Errorf("stale session: got %v", err)
+	}
+
+	// Once the member has a passkey, only sessions that passed two-factor
+	// authentication may add another.
+	m.reauthAt = timestamp()
+	if err := register(t, m, newSoftAuthenticator(t), "none"); err != nil {
+		t.Fatal(err)
+	}
+	m.mfa = false
+	if _, err := m.BeginWebAuthnRegistration(); err != ErrMfaRequired {
+		t.Errorf("session without MFA: got %v", err)
+	}
+}
+
+func TestWebAuthnSigninDB(t *testing.T) {
+	testDB(t)
+
+	m := testMember(t)
+	a := newSoftAuthenticator(t)
+	a.userID = webAuthnUserHandle(m.id)
+	if err := register(t, m, a, "none"); err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := func() string {
+		opts, err := BeginWebAuthnSignin("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return opts["challenge"].(string)
+	}
+
+	c := a.get(t, challenge())
+	if mid, err := authWebAuthn(0, c); err != nil || mid != m.id {
+		t.Fatalf("got %d, %v", mid, err)
+	}
+
+	// The same assertion again is a replay.
+	if _, err := authWebAuthn(0, c); err != ErrInvalidWebAuthn {
+		t.Errorf("challenge reused: got %v", err)
+	}
+
+	// As is a fresh challenge signed with a count we've already seen.
+	a.signCount--
+	if _, err := authWebAuthn(0, a.get(t, challenge())); err != ErrWebAuthnSignCount {
+		t.Errorf("sign count went backwards: got %v", err)
+	}
+	if mid, err := authWebAuthn(0, a.get(t, challenge())); err != nil || mid != m.id {
+		t.Errorf("sign count forwards again: got %d, %v", mid, err)
+	}
+
+	// Without user verification, a passkey alone isn't enough.
+	a.flags = flagUP
+	if _, err := authWebAuthn(0, a.get(t, challenge())); err != ErrInvalidWebAuthn {
+		t.Errorf("no UV: got %v", err)
+	}
+	a.flags = flagUP | flagUV
+
+	// Someone else's key under the same credential id.
+	clone := newSoftAuthenticator(t)
+	clone.credID, clone.signCount = a.credID, 1000
+	if _, err := authWebAuthn(0, clone.get(t, challenge())); err != ErrInvalidWebAuthn {
+		t.Errorf("other key: got %v", err)
+	}
+
+	// The user handle must be the owner's.
+	a.userID = webAuthnUserHandle(m.id + 1)
+	if _, err := authWebAuthn(0, a.get(t, challenge())); err != ErrInvalidWebAuthn {
+		t.Errorf("wrong user handle: got %v", err)
+	}
+}